@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AnthropicRequest Anthropic Messages API 请求结构
+type AnthropicRequest struct {
+	Model         string             `json:"model"`
+	System        json.RawMessage    `json:"system,omitempty"` // 字符串或内容块数组
+	Messages      []AnthropicMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens"`
+	StopSequences json.RawMessage    `json:"stop_sequences,omitempty"` // 字符串数组
+	Stream        bool               `json:"stream,omitempty"`
+	Temperature   float64            `json:"temperature,omitempty"`
+	Thinking      *struct {
+		Type         string `json:"type"`
+		BudgetTokens int    `json:"budget_tokens,omitempty"`
+	} `json:"thinking,omitempty"`
+}
+
+// AnthropicMessage Anthropic 消息结构
+type AnthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"` // 字符串或内容块数组
+}
+
+// AnthropicContentBlock Anthropic 内容块
+type AnthropicContentBlock struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	Thinking string `json:"thinking,omitempty"`
+}
+
+// AnthropicUsage Anthropic 用量结构
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// AnthropicResponse Anthropic 非流式响应结构
+type AnthropicResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   *string                 `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        AnthropicUsage          `json:"usage"`
+}
+
+// anthropicText 将字符串或内容块数组形式的 content 展平成纯文本
+func anthropicText(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	var blocks []AnthropicContentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, b := range blocks {
+		// 只保留文本块，思考块等不回传上游
+		if b.Type == "text" && b.Text != "" {
+			parts = append(parts, b.Text)
+		}
+	}
+	return strings.Join(parts, "\n"), nil
+}
+
+// convertAnthropicMessages 将 Anthropic 请求转换为上游使用的消息列表
+func convertAnthropicMessages(req AnthropicRequest) ([]Message, error) {
+	var messages []Message
+	system, err := anthropicText(req.System)
+	if err != nil {
+		return nil, fmt.Errorf("invalid system: %v", err)
+	}
+	if system != "" {
+		messages = append(messages, Message{Role: "system", Content: system})
+	}
+	for i, m := range req.Messages {
+		text, err := anthropicText(m.Content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content in messages[%d]: %v", i, err)
+		}
+		messages = append(messages, Message{Role: m.Role, Content: text})
+	}
+	return messages, nil
+}
+
+// writeAnthropicError 以 Anthropic 错误格式返回
+func writeAnthropicError(w http.ResponseWriter, status int, errType string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type": "error",
+		"error": map[string]string{
+			"type":    errType,
+			"message": message,
+		},
+	})
+}
+
+// anthropicErrorType Anthropic 没有 timeout_error，上游超时按 api_error 返回
+func anthropicErrorType(errType string) string {
+	if errType == "timeout_error" {
+		return "api_error"
+	}
+	return errType
+}
+
+// anthropicStopReason 将组装器的结束原因映射为 Anthropic 的 stop_reason 与 stop_sequence
+func anthropicStopReason(asm *responseAssembler) (string, *string) {
+	switch asm.FinishReason() {
+	case "length":
+		return "max_tokens", nil
+	case "stop":
+		if seq := asm.StopSequence(); seq != "" {
+			return "stop_sequence", &seq
+		}
+	}
+	return "end_turn", nil
+}
+
+func handleMessages(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeAnthropicError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+		return
+	}
+
+	reqLog := logger(r.Context())
+	reqLog.Debug("收到messages请求")
+	metrics := trackRequest(w, r)
+	defer metrics.Done()
+	w = metrics
+
+	// 验证API Key（优先 x-api-key，兼容 Bearer）
+	apiKey := r.Header.Get("x-api-key")
+	if apiKey == "" {
+		apiKey = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if apiKey == "" {
+		reqLog.Info("缺少x-api-key头")
+		writeAnthropicError(w, http.StatusUnauthorized, "authentication_error", "Missing x-api-key header")
+		return
+	}
+	_, authSpan := tracer.Start(r.Context(), "auth")
+	key, kerr := apiKeys.Authenticate(apiKey)
+	authSpan.End()
+	if kerr != nil {
+		reqLog.Info("无效的API key")
+		writeAnthropicError(w, http.StatusUnauthorized, "authentication_error", "Invalid API key")
+		return
+	}
+	metrics.Key = key.Name
+
+	var req AnthropicRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		reqLog.Info("JSON解析失败", "error", err)
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON")
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "messages: at least one message is required")
+		return
+	}
+	// 与 Messages API 一致，max_tokens 必填
+	if req.MaxTokens <= 0 {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "max_tokens: must be a positive integer")
+		return
+	}
+	stops, err := parseStopSequences(req.StopSequences)
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	model, ok := models.Resolve(req.Model)
+	if !ok {
+		reqLog.Debug("未知模型，使用默认模型", "requested", req.Model, "model", model.ID)
+	}
+	metrics.Model = model.ID
+	if kerr := apiKeys.Admit(key, model); kerr != nil {
+		reqLog.Info("key请求被拒绝", "key", key.Name, "reason", kerr.Message)
+		errType := "permission_error"
+		if kerr.Status == http.StatusTooManyRequests {
+			errType = "rate_limit_error"
+		}
+		writeAnthropicError(w, kerr.Status, errType, kerr.Message)
+		return
+	}
+
+	messages, err := convertAnthropicMessages(req)
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	reqLog.Debug("请求解析成功", "model", req.Model, "stream", req.Stream, "messages", len(messages))
+
+	upstreamReq := buildUpstreamRequest(model, messages)
+	if req.Thinking != nil && req.Thinking.Type == "enabled" {
+		upstreamReq.Features["enable_thinking"] = true
+	}
+	authToken, fail := selectAuthToken(r.Context())
+	if fail != nil {
+		writeAnthropicFailure(w, fail)
+		return
+	}
+	sess := &chatSession{
+		ChatID:    upstreamReq.ChatID,
+		AuthToken: authToken,
+		Model:     req.Model,
+		// thinking 块只需要纯文本，始终去掉标签
+		ThinkTagsMode: "strip",
+		Stop:          stops,
+		MaxTokens:     req.MaxTokens,
+		Metrics:       metrics,
+		Log:           reqLog,
+	}
+	// 重试时可能换用新token，释放最终使用的那个
+	defer func() { upstreamPool.Release(sess.AuthToken) }()
+
+	var usage Usage
+	if req.Stream {
+		usage = streamUpstream(r.Context(), upstreamReq, sess, &anthropicStreamSink{w: w, sess: sess})
+	} else {
+		usage = handleAnthropicNonStream(r.Context(), w, upstreamReq, sess)
+	}
+	apiKeys.RecordTokens(key, usage.TotalTokens)
+	recordTokenMetrics(model.ID, usage)
+}
+
+// writeAnthropicFailure 记录请求结果并以 Anthropic 错误格式返回上游失败
+func writeAnthropicFailure(w http.ResponseWriter, f *upstreamFailure) {
+	requestOutcomes.Inc(f.Outcome)
+	if f.Status != 0 {
+		writeAnthropicError(w, f.Status, anthropicErrorType(f.Type), f.Message)
+	}
+}
+
+// anthropicStreamSink 按 Anthropic SSE 事件格式写出流式响应
+type anthropicStreamSink struct {
+	w         http.ResponseWriter
+	sess      *chatSession
+	opened    bool
+	index     int    // 当前内容块序号
+	blockType string // 当前打开的内容块类型，空表示没有打开的块
+	err       error  // 写入下游失败的错误，非空说明客户端已断开
+}
+
+func (s *anthropicStreamSink) event(name string, data interface{}) {
+	if s.err != nil {
+		return
+	}
+	payload, _ := json.Marshal(data)
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, payload); err != nil {
+		s.err = err
+		return
+	}
+	s.err = http.NewResponseController(s.w).Flush()
+}
+
+// blockDelta 写入一段增量内容，必要时关闭上一个块并打开新块
+func (s *anthropicStreamSink) blockDelta(blockType string, text string) {
+	if text == "" {
+		return
+	}
+	if s.blockType != blockType {
+		s.closeBlock()
+		block := map[string]string{"type": blockType}
+		if blockType == "thinking" {
+			block["thinking"] = ""
+		} else {
+			block["text"] = ""
+		}
+		s.event("content_block_start", map[string]interface{}{
+			"type":          "content_block_start",
+			"index":         s.index,
+			"content_block": block,
+		})
+		s.blockType = blockType
+	}
+	delta := map[string]string{}
+	if blockType == "thinking" {
+		delta["type"] = "thinking_delta"
+		delta["thinking"] = text
+	} else {
+		delta["type"] = "text_delta"
+		delta["text"] = text
+	}
+	s.event("content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": s.index,
+		"delta": delta,
+	})
+}
+
+func (s *anthropicStreamSink) closeBlock() {
+	if s.blockType == "" {
+		return
+	}
+	s.event("content_block_stop", map[string]interface{}{
+		"type":  "content_block_stop",
+		"index": s.index,
+	})
+	s.index++
+	s.blockType = ""
+}
+
+func (s *anthropicStreamSink) Open() bool {
+	s.w.Header().Set("Content-Type", "text/event-stream")
+	s.w.Header().Set("Cache-Control", "no-cache")
+	s.w.Header().Set("Connection", "keep-alive")
+	s.opened = true
+	s.event("message_start", map[string]interface{}{
+		"type": "message_start",
+		"message": AnthropicResponse{
+			ID:      fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+			Type:    "message",
+			Role:    "assistant",
+			Model:   s.sess.Model,
+			Content: []AnthropicContentBlock{},
+		},
+	})
+	return true
+}
+
+func (s *anthropicStreamSink) Delta(d assembledDelta) {
+	s.blockDelta("thinking", d.Reasoning)
+	s.blockDelta("text", d.Content)
+}
+
+// Resumed Anthropic 事件没有元数据字段，续写内容直接接在同一个内容块后
+func (s *anthropicStreamSink) Resumed(count int) {}
+
+func (s *anthropicStreamSink) Close(asm *responseAssembler) {
+	usage := asm.Usage()
+	stopReason, stopSequence := anthropicStopReason(asm)
+	s.closeBlock()
+	s.event("message_delta", map[string]interface{}{
+		"type":  "message_delta",
+		"delta": map[string]interface{}{"stop_reason": stopReason, "stop_sequence": stopSequence},
+		"usage": AnthropicUsage{InputTokens: usage.PromptTokens, OutputTokens: usage.CompletionTokens},
+	})
+	s.event("message_stop", map[string]string{"type": "message_stop"})
+}
+
+// Fail 流已开始时关闭当前内容块并以 error 事件结束，客户端可以区分被截断的回答
+func (s *anthropicStreamSink) Fail(f *upstreamFailure) {
+	if !s.opened {
+		writeAnthropicFailure(s.w, f)
+		return
+	}
+	requestOutcomes.Inc(f.Outcome)
+	if f.Status == 0 {
+		return
+	}
+	s.closeBlock()
+	s.event("error", map[string]interface{}{
+		"type":  "error",
+		"error": map[string]string{"type": anthropicErrorType(f.Type), "message": f.Message},
+	})
+}
+
+func (s *anthropicStreamSink) Gone() bool {
+	return s.err != nil
+}
+
+// handleAnthropicNonStream 收集上游完整响应后以 Anthropic 消息格式返回，返回本次用量
+func handleAnthropicNonStream(ctx context.Context, w http.ResponseWriter, upstreamReq UpstreamRequest, sess *chatSession) Usage {
+	asm, fail := collectUpstream(ctx, upstreamReq, sess)
+	if fail != nil {
+		writeAnthropicFailure(w, fail)
+		return Usage{}
+	}
+
+	content := []AnthropicContentBlock{}
+	if thinking := asm.Reasoning(); thinking != "" {
+		content = append(content, AnthropicContentBlock{Type: "thinking", Thinking: thinking})
+	}
+	content = append(content, AnthropicContentBlock{Type: "text", Text: asm.Content()})
+
+	usage := asm.Usage()
+	stopReason, stopSequence := anthropicStopReason(asm)
+	response := AnthropicResponse{
+		ID:           fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		Type:         "message",
+		Role:         "assistant",
+		Model:        sess.Model,
+		Content:      content,
+		StopReason:   &stopReason,
+		StopSequence: stopSequence,
+		Usage:        AnthropicUsage{InputTokens: usage.PromptTokens, OutputTokens: usage.CompletionTokens},
+	}
+
+	_, flush := tracer.Start(ctx, "downstream.flush")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+	flush.End()
+	sess.Log.Debug("Anthropic非流式响应发送完成", "chat_id", sess.ChatID)
+	requestOutcomes.Inc(outcomeCompleted)
+	return usage
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// assembledDelta 组装器输出的一段下游增量
+type assembledDelta struct {
+	Reasoning string
+	Content   string
+	ToolCalls []ToolCall
+}
+
+// responseAssembler 将上游SSE事件组装为下游响应
+//
+// 流式与非流式路径都逐帧调用 Feed：流式路径把每段增量立即发送出去，
+// 非流式路径在结束后取 Message，因此两者的 content、reasoning_content、
+// tool_calls、finish_reason 与用量完全一致。
+type responseAssembler struct {
+	thinking *thinkingParser
+	tools    *toolCallParser // 为 nil 表示请求未带 tools
+	messages []Message       // 用于上游未返回用量时估算
+	log      *slog.Logger    // 本次请求的日志，带请求ID与trace ID
+
+	stop      *stopMatcher // 为 nil 表示没有停止序列
+	maxTokens int          // 0 表示不限
+	counter   tokenCounter // 已输出（思考+回答）的token数
+
+	reasoning    strings.Builder
+	content      strings.Builder
+	toolCalls    []ToolCall
+	usage        Usage  // 上游返回的用量
+	finishReason string // 因停止序列或 max_tokens 提前结束时的原因
+	finished     bool
+	resumed      bool // 已改用续写请求，上游用量只覆盖续写部分，改为估算
+
+	onFirstToken func() // 首次输出内容时调用，用于记录首token延迟
+}
+
+// newResponseAssembler 创建组装器；mode 为思考标签处理策略，tools 可为 nil，log 为本次请求的日志
+func newResponseAssembler(mode string, tools *toolCallParser, messages []Message, log *slog.Logger) *responseAssembler {
+	return &responseAssembler{
+		thinking: newThinkingParser(mode),
+		tools:    tools,
+		messages: messages,
+		log:      log,
+	}
+}
+
+// SetLimits 设置停止序列与输出token上限（maxTokens<=0 表示不限）
+func (a *responseAssembler) SetLimits(stops []string, maxTokens int) {
+	if len(stops) > 0 {
+		a.stop = &stopMatcher{stops: stops}
+	}
+	a.maxTokens = maxTokens
+}
+
+// Feed 处理一个上游事件，返回需要发送给下游的增量；
+// done 表示上游已给出结束信号，或已遇到停止序列/达到 max_tokens，调用方应停止读取上游
+func (a *responseAssembler) Feed(data *UpstreamData) (d assembledDelta, done bool) {
+	if a.finishReason != "" {
+		return assembledDelta{}, true
+	}
+	if data.Data.Usage.TotalTokens > 0 && !a.resumed {
+		a.usage = data.Data.Usage
+	}
+	reasoning, answer := a.thinking.Frame(data.Data.Phase, data.Data.DeltaContent, data.Data.EditContent)
+	d = a.add(reasoning, answer, false)
+	return d, data.Data.Done || data.Data.Phase == "done" || a.finishReason != ""
+}
+
+// Finish 结束组装，返回剩余的增量（未闭合的思考标签、被截断的半个工具调用标签、暂存的停止序列前缀）
+func (a *responseAssembler) Finish() assembledDelta {
+	if a.finished {
+		return assembledDelta{}
+	}
+	a.finished = true
+	if a.finishReason != "" {
+		return assembledDelta{}
+	}
+	return a.add(a.thinking.Close(), "", true)
+}
+
+// Resumable 上游中断后能否续写：已发出工具调用或已提前结束时不续写；
+// 还没有输出回答（仍在思考阶段）时也不续写，否则重新发送的请求会重复输出思考过程
+func (a *responseAssembler) Resumable() bool {
+	return !a.finished && a.finishReason == "" && len(a.toolCalls) == 0 && a.content.Len() > 0
+}
+
+// Resume 上游中断后改用续写请求的事件：结束当前思考解析，返回需要补发的增量（如未闭合的思考标签）；
+// 停止序列、工具调用解析与 max_tokens 计数沿用原状态
+func (a *responseAssembler) Resume() assembledDelta {
+	d := a.add(a.thinking.Close(), "", false)
+	a.thinking = newThinkingParser(a.thinking.mode)
+	a.usage = Usage{}
+	a.resumed = true
+	return d
+}
+
+// OnFirstToken 设置首次输出思考、回答或工具调用时的回调
+func (a *responseAssembler) OnFirstToken(f func()) {
+	a.onFirstToken = f
+}
+
+func (a *responseAssembler) add(reasoning, answer string, final bool) assembledDelta {
+	d := assembledDelta{Reasoning: reasoning, Content: answer}
+	if a.tools != nil {
+		if answer != "" {
+			d.Content, d.ToolCalls = a.tools.Feed(answer)
+		}
+		if final {
+			// 输出被截断在半个标签处时按原文补发
+			d.Content += a.tools.Flush()
+		}
+	}
+	if a.stop != nil {
+		d.Content = a.stop.Feed(d.Content, final)
+		if a.stop.Hit() {
+			a.log.Debug("遇到停止序列，提前结束", "stop_sequence", a.stop.Matched())
+			a.finishReason = "stop"
+		}
+	}
+	if a.maxTokens > 0 {
+		var ok bool
+		if d.Reasoning, ok = a.counter.Fit(d.Reasoning, a.maxTokens); ok {
+			d.Content, ok = a.counter.Fit(d.Content, a.maxTokens)
+		} else {
+			d.Content = ""
+		}
+		if !ok {
+			a.log.Debug("达到 max_tokens，截断输出", "max_tokens", a.maxTokens)
+			d.ToolCalls = nil
+			a.finishReason = "length"
+		}
+	}
+	if a.onFirstToken != nil && (d.Reasoning != "" || d.Content != "" || len(d.ToolCalls) > 0) {
+		a.onFirstToken()
+		a.onFirstToken = nil
+	}
+	a.reasoning.WriteString(d.Reasoning)
+	a.content.WriteString(d.Content)
+	a.toolCalls = append(a.toolCalls, d.ToolCalls...)
+	return d
+}
+
+// FinishReason 结束原因：length、stop 或 tool_calls
+func (a *responseAssembler) FinishReason() string {
+	if a.finishReason != "" {
+		return a.finishReason
+	}
+	if len(a.toolCalls) > 0 {
+		return "tool_calls"
+	}
+	return "stop"
+}
+
+// StopSequence 因停止序列提前结束时遇到的停止序列，否则为空
+func (a *responseAssembler) StopSequence() string {
+	if a.finishReason != "stop" || a.stop == nil {
+		return ""
+	}
+	return a.stop.Matched()
+}
+
+// Usage 优先使用上游返回的用量，否则按已输出内容估算；思考阶段的token单独计入 reasoning_tokens
+func (a *responseAssembler) Usage() Usage {
+	usage := a.usage
+	if usage.TotalTokens == 0 {
+		usage = estimateUsage(a.messages, a.reasoning.String()+a.content.String())
+	}
+	if usage.CompletionTokensDetails == nil && a.reasoning.Len() > 0 {
+		// 上游不区分思考与回答，按思考内容估算并以 completion_tokens 为上限
+		reasoning := min(estimateTokens(a.reasoning.String()), usage.CompletionTokens)
+		usage.CompletionTokensDetails = &CompletionTokensDetails{ReasoningTokens: reasoning}
+	}
+	return usage
+}
+
+// Reasoning 已输出的全部思考内容
+func (a *responseAssembler) Reasoning() string {
+	return a.reasoning.String()
+}
+
+// Content 已输出的全部回答内容
+func (a *responseAssembler) Content() string {
+	return a.content.String()
+}
+
+// Message 非流式响应中的完整消息
+func (a *responseAssembler) Message() Message {
+	msg := Message{
+		Role:             "assistant",
+		Content:          a.content.String(),
+		ReasoningContent: a.reasoning.String(),
+	}
+	for _, call := range a.toolCalls {
+		// 非流式响应中的工具调用不带 index
+		call.Index = nil
+		msg.ToolCalls = append(msg.ToolCalls, call)
+	}
+	return msg
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config 配置结构体
+//
+// 字段依次取默认值、配置文件（CONFIG_FILE，yaml 标签为文件中的键名）与环境变量（env 标签，
+// 多个名称时取第一个已设置的），后者覆盖前者。
+type Config struct {
+	UpstreamUrl       string `yaml:"upstream_url" env:"UPSTREAM_URL"`
+	DefaultKey        string `yaml:"default_key" env:"DEFAULT_KEY"`
+	UpstreamToken     string `yaml:"upstream_token" env:"UPSTREAM_TOKEN"`
+	DefaultModelName  string `yaml:"default_model_name" env:"DEFAULT_MODEL_NAME"`
+	ThinkingModelName string `yaml:"thinking_model_name" env:"THINKING_MODEL_NAME"`
+	SearchModelName   string `yaml:"search_model_name" env:"SEARCH_MODEL_NAME"`
+	Port              string `yaml:"port" env:"PORT"`
+	DebugMode         bool   `yaml:"debug_mode" env:"DEBUG_MODE"`                                                        // 默认日志级别为 debug；不再输出消息内容
+	LogLevel          string `yaml:"log_level" env:"LOG_LEVEL"`                                                          // debug/info/warn/error，为空时由 DEBUG_MODE 决定
+	LogFormat         string `yaml:"log_format" env:"LOG_FORMAT"`                                                        // json 或 text
+	LogMessageContent bool   `yaml:"log_message_content" env:"LOG_MESSAGE_CONTENT"`                                      // 日志中是否输出消息内容与上游请求体
+	OTLPEndpoint      string `yaml:"otlp_endpoint" env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT,OTEL_EXPORTER_OTLP_ENDPOINT"` // OTLP/HTTP 导出地址，为空时不启用 tracing
+	ThinkTagsMode     string `yaml:"think_tags_mode" env:"THINK_TAGS_MODE"`                                              // strip: 去除<details>标签；think: 转为<think>标签；raw: 保留原样
+	AnonTokenEnabled  bool   `yaml:"anon_token_enabled" env:"ANON_TOKEN_ENABLED"`
+	AnonTokenStrict   bool   `yaml:"anon_token_strict" env:"ANON_TOKEN_STRICT"` // 无法获得匿名token时返回503，不回退共享token
+	FEVersion         string `yaml:"fe_version" env:"FE_VERSION"`               // 上游请求的 X-FE-Version，上游前端升级时修改
+
+	UpstreamTokens     string        `yaml:"upstream_tokens" env:"UPSTREAM_TOKENS"`           // 逗号分隔的token列表，支持 token:weight
+	UpstreamTokensFile string        `yaml:"upstream_tokens_file" env:"UPSTREAM_TOKENS_FILE"` // token文件，每行一个 token[:weight]
+	TokenPoolStrategy  string        `yaml:"token_pool_strategy" env:"TOKEN_POOL_STRATEGY"`   // round_robin / least_inflight / weighted
+	TokenCooldownBase  time.Duration `yaml:"token_cooldown_base" env:"TOKEN_COOLDOWN_BASE"`   // token失效后的初始冷却时间
+	TokenCooldownMax   time.Duration `yaml:"token_cooldown_max" env:"TOKEN_COOLDOWN_MAX"`     // 冷却时间上限
+	AdminKey           string        `yaml:"admin_key" env:"ADMIN_KEY"`                       // 管理接口key，未设置时管理接口关闭
+	KeysFile           string        `yaml:"keys_file" env:"KEYS_FILE"`                       // 多租户API key配置文件（JSON/YAML）
+	ModelsFile         string        `yaml:"models_file" env:"MODELS_FILE"`                   // 模型注册表配置文件（JSON/YAML）
+
+	UpstreamConnectTimeout   time.Duration `yaml:"upstream_connect_timeout" env:"UPSTREAM_CONNECT_TIMEOUT"`       // 建立上游连接（含TLS握手）超时
+	UpstreamFirstByteTimeout time.Duration `yaml:"upstream_first_byte_timeout" env:"UPSTREAM_FIRST_BYTE_TIMEOUT"` // 每次上游请求等待响应头与收到响应头后等待第一个SSE事件的超时
+	UpstreamIdleTimeout      time.Duration `yaml:"upstream_idle_timeout" env:"UPSTREAM_IDLE_TIMEOUT"`             // 相邻两个SSE事件之间的最长间隔
+	UpstreamTotalTimeout     time.Duration `yaml:"upstream_total_timeout" env:"UPSTREAM_TOTAL_TIMEOUT"`           // 每个下游请求的上游总时长上限（含重试与续写），0 表示不限
+	UpstreamRetries          int           `yaml:"upstream_retries" env:"UPSTREAM_RETRIES"`                       // 向下游发送数据前，上游失败的最大重试次数
+	UpstreamRetryBaseDelay   time.Duration `yaml:"upstream_retry_base_delay" env:"UPSTREAM_RETRY_BASE_DELAY"`     // 重试退避的初始等待时间
+	UpstreamRetryMaxDelay    time.Duration `yaml:"upstream_retry_max_delay" env:"UPSTREAM_RETRY_MAX_DELAY"`       // 重试等待上限，Retry-After 超过此值时不再重试
+	UpstreamResumeAttempts   int           `yaml:"upstream_resume_attempts" env:"UPSTREAM_RESUME_ATTEMPTS"`       // 流式响应中途断开后最多续写的次数
+
+	ImageMaxBytes     int64         `yaml:"image_max_bytes" env:"IMAGE_MAX_BYTES"`         // 单张图片大小上限
+	ImageFetchTimeout time.Duration `yaml:"image_fetch_timeout" env:"IMAGE_FETCH_TIMEOUT"` // 下载图片与上传到上游的超时
+	ImageURLFetch     bool          `yaml:"image_url_fetch" env:"IMAGE_URL_FETCH"`         // 是否下载 http(s) 图片地址，默认只接受 data URL
+	ImageURLAllowlist string        `yaml:"image_url_allowlist" env:"IMAGE_URL_ALLOWLIST"` // 允许下载的主机，逗号分隔，.example.com 匹配其子域名；为空时不限主机
+	JSONRepairRetries int           `yaml:"json_repair_retries" env:"JSON_REPAIR_RETRIES"` // 结构化输出校验失败后的重试次数
+
+	ConfigWatchInterval time.Duration `yaml:"config_watch_interval" env:"CONFIG_WATCH_INTERVAL"` // 检查配置文件变化的间隔，0 表示只在 SIGHUP 时重新加载
+
+	// 以下只能在配置文件中设置
+	Keys   []*APIKey      `yaml:"keys"`   // 多租户API key，与 keys_file 二选一
+	Models []*ModelConfig `yaml:"models"` // 模型注册表，与 models_file 二选一
+	Tokens []string       `yaml:"tokens"` // 上游token池，每项为 token[:weight]，与 upstream_tokens 合并
+
+	File string `yaml:"-"` // 配置文件路径（CONFIG_FILE）
+}
+
+// currentConfig 当前生效的配置，热加载时整体替换
+var currentConfig atomic.Pointer[Config]
+
+// config 返回当前配置；返回值只读，请求处理中可能在两次调用之间被替换
+func config() *Config {
+	return currentConfig.Load()
+}
+
+// defaultConfig 未配置时的默认值
+func defaultConfig() *Config {
+	return &Config{
+		UpstreamUrl:              "https://chat.z.ai/api/chat/completions",
+		DefaultKey:               "sk-123456",
+		UpstreamToken:            "eyJ...", // 上游API的token（回退用）
+		DefaultModelName:         "GLM-4.5",
+		ThinkingModelName:        "GLM-4.5-Thinking",
+		SearchModelName:          "GLM-4.5-Search",
+		Port:                     ":3007",
+		DebugMode:                true,
+		LogFormat:                "json",
+		ThinkTagsMode:            "think",
+		AnonTokenEnabled:         true,
+		FEVersion:                XFeVersion,
+		TokenPoolStrategy:        strategyRoundRobin,
+		TokenCooldownBase:        30 * time.Second,
+		TokenCooldownMax:         30 * time.Minute,
+		UpstreamConnectTimeout:   10 * time.Second,
+		UpstreamFirstByteTimeout: 60 * time.Second,
+		UpstreamIdleTimeout:      60 * time.Second,
+		UpstreamTotalTimeout:     10 * time.Minute,
+		UpstreamRetries:          2,
+		UpstreamRetryBaseDelay:   500 * time.Millisecond,
+		UpstreamRetryMaxDelay:    10 * time.Second,
+		UpstreamResumeAttempts:   1,
+		ImageMaxBytes:            10 << 20,
+		ImageFetchTimeout:        30 * time.Second,
+		JSONRepairRetries:        2,
+		ConfigWatchInterval:      5 * time.Second,
+	}
+}
+
+// loadConfig 依次应用默认值、配置文件与环境变量，并严格校验；任何一项无效都返回错误
+func loadConfig() (*Config, error) {
+	c := defaultConfig()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+		c.File = path
+	}
+	envErr := c.applyEnv()
+	// 一次列出环境变量与取值范围的所有问题
+	if err := errors.Join(envErr, c.validate()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadFile 读取YAML或JSON配置文件（JSON按YAML解析），未知的键与类型不符的值都视为错误
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("parse %s: %v", path, err)
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv 用已设置的环境变量覆盖配置，无法解析的值汇总返回
+func (c *Config) applyEnv() error {
+	var errs []error
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		tag := v.Type().Field(i).Tag.Get("env")
+		if tag == "" {
+			continue
+		}
+		for _, name := range strings.Split(tag, ",") {
+			value := os.Getenv(name)
+			if value == "" {
+				continue
+			}
+			if err := setConfigField(v.Field(i), value); err != nil {
+				errs = append(errs, fmt.Errorf("%s=%q: %v", name, value, err))
+			}
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setConfigField 按字段类型解析环境变量的值
+func setConfigField(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.New("expected a duration such as 500ms, 30s or 5m")
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("expected true or false")
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Int || field.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("expected an integer")
+		}
+		field.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported config type %s", field.Type())
+	}
+	return nil
+}
+
+// validate 检查取值范围与枚举值，返回所有问题
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	u, err := url.Parse(c.UpstreamUrl)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+		"upstream_url (UPSTREAM_URL): must be an http or https URL, got %q", c.UpstreamUrl)
+	check(c.Port != "", "port (PORT): must not be empty")
+	check(c.DefaultKey != "" || c.KeysFile != "" || len(c.Keys) > 0, "default_key (DEFAULT_KEY): must not be empty when no keys are configured")
+	var level slog.Level
+	check(c.LogLevel == "" || level.UnmarshalText([]byte(c.LogLevel)) == nil,
+		"log_level (LOG_LEVEL): must be one of debug, info, warn, error, got %q", c.LogLevel)
+	check(oneOf(strings.ToLower(c.LogFormat), "json", "text"), "log_format (LOG_FORMAT): must be json or text, got %q", c.LogFormat)
+	check(validThinkTagsMode(c.ThinkTagsMode), "think_tags_mode (THINK_TAGS_MODE): must be one of strip, think, raw, got %q", c.ThinkTagsMode)
+	check(c.FEVersion != "" && !strings.ContainsAny(c.FEVersion, " \t\r\n"), "fe_version (FE_VERSION): must be a non-empty string without whitespace, such as prod-fe-1.0.70, got %q", c.FEVersion)
+	check(oneOf(c.TokenPoolStrategy, strategyRoundRobin, strategyLeastInFlight, strategyWeighted),
+		"token_pool_strategy (TOKEN_POOL_STRATEGY): must be one of round_robin, least_inflight, weighted, got %q", c.TokenPoolStrategy)
+	check(c.TokenCooldownBase > 0, "token_cooldown_base (TOKEN_COOLDOWN_BASE): must be positive, got %v", c.TokenCooldownBase)
+	check(c.TokenCooldownMax >= c.TokenCooldownBase, "token_cooldown_max (TOKEN_COOLDOWN_MAX): must not be less than token_cooldown_base, got %v", c.TokenCooldownMax)
+	check(c.UpstreamConnectTimeout > 0, "upstream_connect_timeout (UPSTREAM_CONNECT_TIMEOUT): must be positive, got %v", c.UpstreamConnectTimeout)
+	check(c.UpstreamFirstByteTimeout > 0, "upstream_first_byte_timeout (UPSTREAM_FIRST_BYTE_TIMEOUT): must be positive, got %v", c.UpstreamFirstByteTimeout)
+	check(c.UpstreamIdleTimeout > 0, "upstream_idle_timeout (UPSTREAM_IDLE_TIMEOUT): must be positive, got %v", c.UpstreamIdleTimeout)
+	check(c.UpstreamTotalTimeout >= 0, "upstream_total_timeout (UPSTREAM_TOTAL_TIMEOUT): must not be negative, got %v", c.UpstreamTotalTimeout)
+	check(c.UpstreamRetries >= 0, "upstream_retries (UPSTREAM_RETRIES): must not be negative, got %d", c.UpstreamRetries)
+	check(c.UpstreamRetryBaseDelay >= 0, "upstream_retry_base_delay (UPSTREAM_RETRY_BASE_DELAY): must not be negative, got %v", c.UpstreamRetryBaseDelay)
+	check(c.UpstreamRetryMaxDelay >= c.UpstreamRetryBaseDelay, "upstream_retry_max_delay (UPSTREAM_RETRY_MAX_DELAY): must not be less than upstream_retry_base_delay, got %v", c.UpstreamRetryMaxDelay)
+	check(c.UpstreamResumeAttempts >= 0, "upstream_resume_attempts (UPSTREAM_RESUME_ATTEMPTS): must not be negative, got %d", c.UpstreamResumeAttempts)
+	check(c.ImageMaxBytes > 0, "image_max_bytes (IMAGE_MAX_BYTES): must be positive, got %d", c.ImageMaxBytes)
+	check(c.ImageFetchTimeout > 0, "image_fetch_timeout (IMAGE_FETCH_TIMEOUT): must be positive, got %v", c.ImageFetchTimeout)
+	check(c.JSONRepairRetries >= 0, "json_repair_retries (JSON_REPAIR_RETRIES): must not be negative, got %d", c.JSONRepairRetries)
+	check(c.ConfigWatchInterval >= 0, "config_watch_interval (CONFIG_WATCH_INTERVAL): must not be negative, got %v", c.ConfigWatchInterval)
+	check(!c.AnonTokenStrict || c.AnonTokenEnabled, "anon_token_strict (ANON_TOKEN_STRICT): requires anon_token_enabled (ANON_TOKEN_ENABLED)")
+	check(c.KeysFile == "" || len(c.Keys) == 0, "keys: cannot be combined with keys_file (KEYS_FILE)")
+	check(c.ModelsFile == "" || len(c.Models) == 0, "models: cannot be combined with models_file (MODELS_FILE)")
+	return errors.Join(errs...)
+}
+
+func oneOf(value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+// validThinkTagsMode 思考标签处理策略是否有效
+func validThinkTagsMode(mode string) bool {
+	return oneOf(mode, "strip", "think", "raw")
+}
+
+// reloadMu 串行化 SIGHUP、文件变化与管理接口触发的重新加载
+var reloadMu sync.Mutex
+
+// reloadConfig 重新读取配置文件、环境变量以及key、模型与token文件，全部校验通过后才替换，
+// 否则保留当前配置。进行中的请求继续使用已建立的上游连接与会话参数，不会被中断。
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	next, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	keys, err := loadKeys(next)
+	if err != nil {
+		return err
+	}
+	list, byName, err := loadModels(next)
+	if err != nil {
+		return err
+	}
+	specs, err := loadTokenSpecs(next)
+	if err != nil {
+		return err
+	}
+
+	prev := config()
+	var restart []string
+	if next.Port != prev.Port {
+		restart = append(restart, "port")
+	}
+	if next.OTLPEndpoint != prev.OTLPEndpoint {
+		restart = append(restart, "otlp_endpoint")
+	}
+	if next.UpstreamConnectTimeout != prev.UpstreamConnectTimeout {
+		restart = append(restart, "upstream_connect_timeout")
+	}
+	if next.ConfigWatchInterval != prev.ConfigWatchInterval {
+		restart = append(restart, "config_watch_interval")
+	}
+	if len(restart) > 0 {
+		slog.Warn("以下配置项需要重启才能生效", "fields", restart)
+	}
+
+	currentConfig.Store(next)
+	initLogger()
+	apiKeys.set(keys)
+	models.set(list, byName)
+	upstreamPool.Update(specs, next.TokenPoolStrategy, next.TokenCooldownBase, next.TokenCooldownMax)
+	slog.Info("配置已重新加载", "keys", len(keys), "models", len(list), "token_pool", len(specs))
+	return nil
+}
+
+// watchedFiles 热加载关注的文件
+func (c *Config) watchedFiles() []string {
+	var files []string
+	for _, f := range []string{c.File, c.KeysFile, c.ModelsFile, c.UpstreamTokensFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// watchConfigFiles 按 CONFIG_WATCH_INTERVAL 检查配置文件的修改时间与大小，变化时重新加载
+func watchConfigFiles(interval time.Duration) {
+	stamp := func() string {
+		var b strings.Builder
+		for _, f := range config().watchedFiles() {
+			if fi, err := os.Stat(f); err == nil {
+				fmt.Fprintf(&b, "%s:%d:%d;", f, fi.ModTime().UnixNano(), fi.Size())
+			} else {
+				fmt.Fprintf(&b, "%s:missing;", f)
+			}
+		}
+		return b.String()
+	}
+	last := stamp()
+	for range time.Tick(interval) {
+		current := stamp()
+		if current == last {
+			continue
+		}
+		// 无论成功与否都记下本次状态，避免无效文件在每个周期重复报错
+		last = current
+		slog.Info("检测到配置文件变化，重新加载")
+		if err := reloadConfig(); err != nil {
+			slog.Error("重新加载配置失败，继续使用当前配置", "error", err)
+		} else {
+			last = stamp()
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearConfigEnv 清空所有配置相关的环境变量（空值视为未设置），避免受运行环境影响
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		for _, name := range strings.Split(typ.Field(i).Tag.Get("env"), ",") {
+			if name != "" {
+				t.Setenv(name, "")
+			}
+		}
+	}
+}
+
+// writeConfigFile 写入临时配置文件并设置 CONFIG_FILE
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	return path
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr []string // 为空表示应通过
+		check   func(c *Config) bool
+	}{
+		{
+			name:  "defaults",
+			check: func(c *Config) bool { return c.ThinkTagsMode == "think" && c.UpstreamIdleTimeout == 60*time.Second },
+		},
+		{
+			name: "typed values",
+			env:  map[string]string{"DEBUG_MODE": "false", "UPSTREAM_IDLE_TIMEOUT": "1500ms", "UPSTREAM_RETRIES": "5", "THINK_TAGS_MODE": "raw"},
+			check: func(c *Config) bool {
+				return !c.DebugMode && c.UpstreamIdleTimeout == 1500*time.Millisecond && c.UpstreamRetries == 5 && c.ThinkTagsMode == "raw"
+			},
+		},
+		{
+			name:  "second env name as fallback",
+			env:   map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"},
+			check: func(c *Config) bool { return c.OTLPEndpoint == "http://collector:4318" },
+		},
+		{
+			name:  "first env name wins",
+			env:   map[string]string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://a:4318", "OTEL_EXPORTER_OTLP_ENDPOINT": "http://b:4318"},
+			check: func(c *Config) bool { return c.OTLPEndpoint == "http://a:4318" },
+		},
+		{
+			name:    "bad bool",
+			env:     map[string]string{"DEBUG_MODE": "yes please"},
+			wantErr: []string{`DEBUG_MODE="yes please": expected true or false`},
+		},
+		{
+			name:    "duration without unit",
+			env:     map[string]string{"UPSTREAM_IDLE_TIMEOUT": "30"},
+			wantErr: []string{`UPSTREAM_IDLE_TIMEOUT="30": expected a duration`},
+		},
+		{
+			name:    "bad integer",
+			env:     map[string]string{"UPSTREAM_RETRIES": "three"},
+			wantErr: []string{`UPSTREAM_RETRIES="three": expected an integer`},
+		},
+		{
+			name:    "bad think tags mode",
+			env:     map[string]string{"THINK_TAGS_MODE": "html"},
+			wantErr: []string{"think_tags_mode (THINK_TAGS_MODE): must be one of strip, think, raw"},
+		},
+		{
+			name:    "bad log format",
+			env:     map[string]string{"LOG_FORMAT": "xml"},
+			wantErr: []string{"log_format (LOG_FORMAT): must be json or text"},
+		},
+		{
+			name:    "bad log level",
+			env:     map[string]string{"LOG_LEVEL": "verbose"},
+			wantErr: []string{"log_level (LOG_LEVEL)"},
+		},
+		{
+			name:    "bad token pool strategy",
+			env:     map[string]string{"TOKEN_POOL_STRATEGY": "random"},
+			wantErr: []string{"token_pool_strategy (TOKEN_POOL_STRATEGY)"},
+		},
+		{
+			name:    "bad upstream url",
+			env:     map[string]string{"UPSTREAM_URL": "ftp://example.com"},
+			wantErr: []string{"upstream_url (UPSTREAM_URL)"},
+		},
+		{
+			name:    "out of range values",
+			env:     map[string]string{"UPSTREAM_RETRIES": "-1", "TOKEN_COOLDOWN_BASE": "1m", "TOKEN_COOLDOWN_MAX": "30s"},
+			wantErr: []string{"upstream_retries (UPSTREAM_RETRIES): must not be negative", "token_cooldown_max (TOKEN_COOLDOWN_MAX)"},
+		},
+		{
+			name:    "strict anonymous token without anonymous tokens",
+			env:     map[string]string{"ANON_TOKEN_ENABLED": "false", "ANON_TOKEN_STRICT": "true"},
+			wantErr: []string{"anon_token_strict (ANON_TOKEN_STRICT): requires anon_token_enabled"},
+		},
+		{
+			name:    "parse and range errors reported together",
+			env:     map[string]string{"DEBUG_MODE": "maybe", "LOG_FORMAT": "xml"},
+			wantErr: []string{"DEBUG_MODE=", "log_format (LOG_FORMAT)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			c, err := loadConfig()
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !tt.check(c) {
+					t.Errorf("unexpected config: %+v", c)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("want an error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		wantErr string // 为空表示应通过
+		check   func(c *Config) bool
+	}{
+		{
+			name: "file values",
+			file: "port: \"9000\"\nthink_tags_mode: strip\nupstream_idle_timeout: 90s\n",
+			check: func(c *Config) bool {
+				return c.Port == "9000" && c.ThinkTagsMode == "strip" && c.UpstreamIdleTimeout == 90*time.Second
+			},
+		},
+		{
+			name:  "env overrides file",
+			file:  "port: \"9000\"\nthink_tags_mode: strip\n",
+			env:   map[string]string{"PORT": "9100"},
+			check: func(c *Config) bool { return c.Port == "9100" && c.ThinkTagsMode == "strip" },
+		},
+		{
+			name:  "empty file keeps defaults",
+			file:  "",
+			check: func(c *Config) bool { return c.ThinkTagsMode == "think" },
+		},
+		{
+			name:    "unknown key",
+			file:    "port: \"9000\"\nthink_tag_mode: strip\n",
+			wantErr: "field think_tag_mode not found",
+		},
+		{
+			name:    "wrong type",
+			file:    "debug_mode: sometimes\n",
+			wantErr: "parse ",
+		},
+		{
+			name:    "invalid enum in file",
+			file:    "token_pool_strategy: random\n",
+			wantErr: "token_pool_strategy (TOKEN_POOL_STRATEGY)",
+		},
+		{
+			name:  "invalid file value fixed by env",
+			file:  "token_pool_strategy: random\n",
+			env:   map[string]string{"TOKEN_POOL_STRATEGY": "weighted"},
+			check: func(c *Config) bool { return c.TokenPoolStrategy == strategyWeighted },
+		},
+		{
+			name:    "keys combined with keys_file",
+			file:    "keys_file: keys.json\nkeys:\n  - key: sk-a\n",
+			wantErr: "keys: cannot be combined with keys_file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			path := writeConfigFile(t, tt.file)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			c, err := loadConfig()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if c.File != path || !tt.check(c) {
+					t.Errorf("unexpected config: %+v", c)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfigFile(t, "think_tags_mode: strip\nkeys:\n  - key: sk-a\n    name: a\n")
+
+	// 与 main 相同的初始化，测试结束后恢复全局状态
+	prevConfig, prevKeys, prevModels, prevPool, prevLogger := config(), apiKeys, models, upstreamPool, slog.Default()
+	t.Cleanup(func() {
+		currentConfig.Store(prevConfig)
+		apiKeys, models, upstreamPool = prevKeys, prevModels, prevPool
+		slog.SetDefault(prevLogger)
+	})
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentConfig.Store(cfg)
+	specs, err := loadTokenSpecs(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamPool = newTokenPool(specs, cfg.TokenPoolStrategy, cfg.TokenCooldownBase, cfg.TokenCooldownMax)
+	if apiKeys, err = newKeyStore(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if models, err = newModelRegistry(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		wantErr string // 为空表示应重新加载成功
+		mode    string // 重新加载后生效的 think_tags_mode
+		key     string // 重新加载后可用的key
+	}{
+		{"invalid enum keeps old config", "think_tags_mode: html\nkeys:\n  - key: sk-b\n", nil, "think_tags_mode", "strip", "sk-a"},
+		{"unknown key keeps old config", "think_tags_mod: raw\nkeys:\n  - key: sk-b\n", nil, "field think_tags_mod not found", "strip", "sk-a"},
+		{"invalid env keeps old config", "think_tags_mode: raw\nkeys:\n  - key: sk-b\n", map[string]string{"UPSTREAM_RETRIES": "many"}, "UPSTREAM_RETRIES", "strip", "sk-a"},
+		{"invalid keys keep old config", "think_tags_mode: raw\nkeys:\n  - key: sk-b\n  - key: sk-b\n", nil, "duplicate key", "strip", "sk-a"},
+		{"valid change applied", "think_tags_mode: raw\nkeys:\n  - key: sk-b\n", nil, "", "raw", "sk-b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			before := config()
+			err := reloadConfig()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want it to contain %q", err, tt.wantErr)
+				}
+				if config() != before {
+					t.Error("config replaced after a failed reload")
+				}
+			}
+			if config().ThinkTagsMode != tt.mode {
+				t.Errorf("think_tags_mode %q, want %q", config().ThinkTagsMode, tt.mode)
+			}
+			if _, kerr := apiKeys.Authenticate(tt.key); kerr != nil {
+				t.Errorf("key %s rejected after reload", tt.key)
+			}
+		})
+	}
+}
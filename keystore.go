@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// APIKey 下游API key及其配额
+type APIKey struct {
+	Key           string   `json:"key" yaml:"key"`
+	Name          string   `json:"name" yaml:"name"`
+	Models        []string `json:"models,omitempty" yaml:"models,omitempty"`                   // 允许使用的模型，空表示不限
+	RPM           int      `json:"rpm,omitempty" yaml:"rpm,omitempty"`                         // 每分钟请求数上限，0 表示不限
+	DailyTokens   int      `json:"daily_tokens,omitempty" yaml:"daily_tokens,omitempty"`       // 每日token预算，0 表示不限
+	ThinkTagsMode string   `json:"think_tags_mode,omitempty" yaml:"think_tags_mode,omitempty"` // 强制的思考标签处理策略
+}
+
+// keyUsage 单个key的用量统计
+type keyUsage struct {
+	requests []time.Time // 最近一分钟内的请求时间
+	day      string
+	tokens   int
+}
+
+// keyStore 下游API key存储，支持热加载
+type keyStore struct {
+	mu    sync.Mutex
+	keys  map[string]*APIKey
+	usage map[string]*keyUsage // 按key保存，重新加载后保留
+}
+
+// 全局key存储
+var apiKeys *keyStore
+
+// keyError 鉴权或配额检查失败
+type keyError struct {
+	Status  int
+	Type    string
+	Code    string
+	Message string
+}
+
+func (e *keyError) Error() string {
+	return e.Message
+}
+
+// newKeyStore 按配置创建key存储
+func newKeyStore(c *Config) (*keyStore, error) {
+	keys, err := loadKeys(c)
+	if err != nil {
+		return nil, err
+	}
+	s := &keyStore{usage: map[string]*keyUsage{}}
+	s.set(keys)
+	return s, nil
+}
+
+// loadKeys 读取key列表：配置文件中的 keys、KEYS_FILE，都未设置时仅包含 DEFAULT_KEY
+func loadKeys(c *Config) (map[string]*APIKey, error) {
+	list := c.Keys
+	source := "keys"
+	if c.KeysFile != "" {
+		data, err := os.ReadFile(c.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+		var file struct {
+			Keys []*APIKey `json:"keys" yaml:"keys"`
+		}
+		switch strings.ToLower(filepath.Ext(c.KeysFile)) {
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(data, &file)
+		default:
+			err = json.Unmarshal(data, &file)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %v", c.KeysFile, err)
+		}
+		list = file.Keys
+		source = c.KeysFile
+	}
+	if len(list) == 0 && c.KeysFile == "" {
+		return map[string]*APIKey{c.DefaultKey: {Key: c.DefaultKey, Name: "default"}}, nil
+	}
+
+	keys := map[string]*APIKey{}
+	for i, k := range list {
+		if k.Key == "" {
+			return nil, fmt.Errorf("%s: keys[%d]: key is required", source, i)
+		}
+		if keys[k.Key] != nil {
+			return nil, fmt.Errorf("%s: keys[%d]: duplicate key", source, i)
+		}
+		if k.ThinkTagsMode != "" && !validThinkTagsMode(k.ThinkTagsMode) {
+			return nil, fmt.Errorf("%s: keys[%d]: think_tags_mode must be one of strip, think, raw, got %q", source, i, k.ThinkTagsMode)
+		}
+		if k.Name == "" {
+			k.Name = fmt.Sprintf("key-%d", i)
+		}
+		keys[k.Key] = k
+	}
+	return keys, nil
+}
+
+// set 替换key列表，已有key的用量统计保留
+func (s *keyStore) set(keys map[string]*APIKey) {
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	debugLog("已加载%d个API key", len(keys))
+}
+
+// Authenticate 查找API key
+func (s *keyStore) Authenticate(key string) (*APIKey, *keyError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.keys[key]
+	if k == nil {
+		return nil, &keyError{http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "Invalid API key"}
+	}
+	return k, nil
+}
+
+// AllowsModel key是否可以使用该模型
+func (k *APIKey) AllowsModel(model string) bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+	for _, m := range k.Models {
+		if strings.EqualFold(m, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// Admit 检查模型权限与配额，通过时计入一次请求
+func (s *keyStore) Admit(k *APIKey, model *ModelConfig) *keyError {
+	if !model.allowedBy(k) {
+		return &keyError{http.StatusForbidden, "invalid_request_error", "model_not_allowed",
+			fmt.Sprintf("The model `%s` is not allowed for this API key", model.ID)}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.usageLocked(k.Key)
+	now := time.Now()
+
+	if k.DailyTokens > 0 && u.tokens >= k.DailyTokens {
+		return &keyError{http.StatusTooManyRequests, "insufficient_quota", "insufficient_quota",
+			fmt.Sprintf("Daily token budget of %d exceeded", k.DailyTokens)}
+	}
+
+	if k.RPM > 0 {
+		cutoff := now.Add(-time.Minute)
+		recent := u.requests[:0]
+		for _, t := range u.requests {
+			if t.After(cutoff) {
+				recent = append(recent, t)
+			}
+		}
+		u.requests = recent
+		if len(u.requests) >= k.RPM {
+			return &keyError{http.StatusTooManyRequests, "requests", "rate_limit_exceeded",
+				fmt.Sprintf("Rate limit reached: %d requests per minute", k.RPM)}
+		}
+		u.requests = append(u.requests, now)
+	}
+	return nil
+}
+
+// RecordTokens 记录本次请求消耗的token
+func (s *keyStore) RecordTokens(k *APIKey, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usageLocked(k.Key).tokens += tokens
+}
+
+// usageLocked 获取key的用量，跨天时重置每日token
+func (s *keyStore) usageLocked(key string) *keyUsage {
+	u := s.usage[key]
+	if u == nil {
+		u = &keyUsage{}
+		s.usage[key] = u
+	}
+	if today := time.Now().Format("2006-01-02"); u.day != today {
+		u.day = today
+		u.tokens = 0
+	}
+	return u
+}
+
+// writeKeyError 以OpenAI错误格式返回鉴权/配额错误
+func writeKeyError(w http.ResponseWriter, e *keyError) {
+	if e.Status == http.StatusTooManyRequests && e.Code == "rate_limit_exceeded" {
+		w.Header().Set("Retry-After", strconv.Itoa(60))
+	}
+	writeOpenAIError(w, e.Status, e.Type, e.Code, e.Message)
+}
+
+// authenticateRequest 校验 Authorization 头中的Bearer key
+func authenticateRequest(w http.ResponseWriter, r *http.Request) *APIKey {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		logger(r.Context()).Info("缺少或无效的Authorization头")
+		writeOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "Missing or invalid Authorization header")
+		return nil
+	}
+	key, kerr := apiKeys.Authenticate(strings.TrimPrefix(authHeader, "Bearer "))
+	if kerr != nil {
+		logger(r.Context()).Info("无效的API key")
+		writeKeyError(w, kerr)
+		return nil
+	}
+	logger(r.Context()).Debug("API key验证通过", "key", key.Name)
+	return key
+}
+
+func handleAdminKeysReload(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "Method not allowed")
+		return
+	}
+	if err := reloadConfig(); err != nil {
+		logger(r.Context()).Error("重新加载配置失败", "error", err)
+		writeOpenAIError(w, http.StatusInternalServerError, "api_error", "reload_failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "reloaded"})
+}
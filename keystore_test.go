@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string // KEYS_FILE 的文件名与内容，为空时不使用文件
+		content string
+		keys    []*APIKey // 配置文件中的 keys
+		want    map[string]string
+		wantErr string
+	}{
+		{name: "default key only", want: map[string]string{"sk-default": "default"}},
+		{
+			name: "config keys",
+			keys: []*APIKey{{Key: "sk-a", Name: "a"}, {Key: "sk-b"}},
+			want: map[string]string{"sk-a": "a", "sk-b": "key-1"},
+		},
+		{
+			name:    "json file",
+			file:    "keys.json",
+			content: `{"keys":[{"key":"sk-a","name":"a","rpm":10}]}`,
+			want:    map[string]string{"sk-a": "a"},
+		},
+		{
+			name:    "yaml file",
+			file:    "keys.yaml",
+			content: "keys:\n  - key: sk-a\n  - key: sk-b\n    name: b\n",
+			want:    map[string]string{"sk-a": "key-0", "sk-b": "b"},
+		},
+		{
+			name:    "empty file allows no keys",
+			file:    "keys.json",
+			content: `{"keys":[]}`,
+			want:    map[string]string{},
+		},
+		{name: "duplicate key", keys: []*APIKey{{Key: "sk-a"}, {Key: "sk-a"}}, wantErr: "keys: keys[1]: duplicate key"},
+		{name: "missing key", keys: []*APIKey{{Name: "a"}}, wantErr: "keys: keys[0]: key is required"},
+		{name: "bad think tags mode", keys: []*APIKey{{Key: "sk-a", ThinkTagsMode: "html"}}, wantErr: "think_tags_mode must be one of"},
+		{name: "invalid file", file: "keys.json", content: `{"keys":`, wantErr: "parse "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{DefaultKey: "sk-default", Keys: tt.keys}
+			if tt.file != "" {
+				c.KeysFile = filepath.Join(t.TempDir(), tt.file)
+				if err := os.WriteFile(c.KeysFile, []byte(tt.content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			keys, err := loadKeys(c)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(keys) != len(tt.want) {
+				t.Fatalf("got %d keys, want %d", len(keys), len(tt.want))
+			}
+			for key, name := range tt.want {
+				if keys[key] == nil || keys[key].Name != name {
+					t.Errorf("key %s: got %+v, want name %q", key, keys[key], name)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyStoreReloadKeepsUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 与 reloadConfig 相同：重新读取文件后替换key列表
+	reload := func(s *keyStore) {
+		keys, err := loadKeys(&Config{KeysFile: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.set(keys)
+	}
+	admit := func(s *keyStore, key string) *keyError {
+		k, kerr := s.Authenticate(key)
+		if kerr != nil {
+			return kerr
+		}
+		return s.Admit(k, &ModelConfig{ID: "GLM-4.5"})
+	}
+
+	write("keys:\n  - key: sk-a\n    rpm: 2\n    daily_tokens: 100\n  - key: sk-b\n")
+	s, err := newKeyStore(&Config{KeysFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kerr := admit(s, "sk-a"); kerr != nil {
+		t.Fatalf("first request rejected: %v", kerr)
+	}
+	k, _ := s.Authenticate("sk-a")
+	s.RecordTokens(k, 60)
+
+	// 修改配额并移除 sk-b：sk-a 的请求计数与已用token保留
+	write("keys:\n  - key: sk-a\n    name: renamed\n    rpm: 2\n    daily_tokens: 100\n")
+	reload(s)
+	if k, _ := s.Authenticate("sk-a"); k == nil || k.Name != "renamed" {
+		t.Fatalf("reloaded key not applied: %+v", k)
+	}
+	if _, kerr := s.Authenticate("sk-b"); kerr == nil || kerr.Status != http.StatusUnauthorized {
+		t.Errorf("removed key still accepted: %v", kerr)
+	}
+	if kerr := admit(s, "sk-a"); kerr != nil {
+		t.Fatalf("second request rejected: %v", kerr)
+	}
+	if kerr := admit(s, "sk-a"); kerr == nil || kerr.Code != "rate_limit_exceeded" {
+		t.Errorf("third request within a minute: got %v, want rate_limit_exceeded", kerr)
+	}
+
+	// 预算降低后，已用的60个token立即生效
+	write("keys:\n  - key: sk-a\n    daily_tokens: 50\n")
+	reload(s)
+	if kerr := admit(s, "sk-a"); kerr == nil || kerr.Code != "insufficient_quota" {
+		t.Errorf("got %v, want insufficient_quota", kerr)
+	}
+
+	// 移除后再加回的key同样保留用量
+	write("keys:\n  - key: sk-b\n")
+	reload(s)
+	write("keys:\n  - key: sk-a\n    daily_tokens: 100\n")
+	reload(s)
+	k, _ = s.Authenticate("sk-a")
+	s.RecordTokens(k, 40)
+	if kerr := admit(s, "sk-a"); kerr == nil || kerr.Code != "insufficient_quota" {
+		t.Errorf("usage lost after the key was removed and re-added: %v", kerr)
+	}
+}
+
+func TestKeyStoreAdmitModel(t *testing.T) {
+	s := &keyStore{usage: map[string]*keyUsage{}}
+	s.set(map[string]*APIKey{"sk-a": {Key: "sk-a", Models: []string{"gpt-4o"}}})
+	k, _ := s.Authenticate("sk-a")
+	tests := []struct {
+		name  string
+		model *ModelConfig
+		ok    bool
+	}{
+		{"alias allowed", &ModelConfig{ID: "GLM-4.5", Aliases: []string{"GPT-4o"}}, true},
+		{"id allowed", &ModelConfig{ID: "gpt-4o"}, true},
+		{"not allowed", &ModelConfig{ID: "GLM-4.5-Thinking"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kerr := s.Admit(k, tt.model)
+			if (kerr == nil) != tt.ok {
+				t.Errorf("got %v, want ok=%v", kerr, tt.ok)
+			}
+			if kerr != nil && (kerr.Status != http.StatusForbidden || kerr.Code != "model_not_allowed") {
+				t.Errorf("unexpected error %+v", kerr)
+			}
+		})
+	}
+}
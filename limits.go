@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// 最多允许的停止序列数，与OpenAI一致
+const maxStopSequences = 4
+
+// parseStop 解析 stop 参数：字符串或字符串数组
+func parseStop(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		if one == "" {
+			return nil, nil
+		}
+		return []string{one}, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("stop must be a string or an array of strings")
+	}
+	if len(list) > maxStopSequences {
+		return nil, fmt.Errorf("stop supports at most %d sequences", maxStopSequences)
+	}
+	return nonEmptyStops(list), nil
+}
+
+// parseStopSequences 解析 Anthropic 的 stop_sequences：字符串数组，空字符串会立即匹配，忽略
+func parseStopSequences(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("stop_sequences: must be an array of strings")
+	}
+	return nonEmptyStops(list), nil
+}
+
+// nonEmptyStops 去掉空的停止序列
+func nonEmptyStops(list []string) []string {
+	var stops []string
+	for _, s := range list {
+		if s != "" {
+			stops = append(stops, s)
+		}
+	}
+	return stops
+}
+
+// stopMatcher 在增量输出中查找停止序列，可能是停止序列开头的尾部会暂存到下一段
+type stopMatcher struct {
+	stops   []string
+	held    string
+	hit     bool
+	matched string // 遇到的停止序列
+}
+
+// Feed 输入一段内容，返回可以输出的部分；final 表示不会再有后续内容
+func (m *stopMatcher) Feed(s string, final bool) string {
+	if m.hit {
+		return ""
+	}
+	s = m.held + s
+	m.held = ""
+
+	idx := -1
+	for _, stop := range m.stops {
+		if i := strings.Index(s, stop); i >= 0 && (idx < 0 || i < idx) {
+			idx = i
+			m.matched = stop
+		}
+	}
+	if idx >= 0 {
+		m.hit = true
+		return s[:idx]
+	}
+	if final {
+		return s
+	}
+
+	keep := 0
+	for _, stop := range m.stops {
+		keep = max(keep, partialSuffix(s, stop))
+	}
+	m.held = s[len(s)-keep:]
+	return s[:len(s)-keep]
+}
+
+// Hit 是否已遇到停止序列
+func (m *stopMatcher) Hit() bool {
+	return m.hit
+}
+
+// Matched 遇到的停止序列，未遇到时为空
+func (m *stopMatcher) Matched() string {
+	return m.matched
+}
+
+// tokenCounter 增量统计token数，估算方式与 estimateTokens 相同
+type tokenCounter struct {
+	ascii, other int
+}
+
+// Tokens 当前累计的token数
+func (c *tokenCounter) Tokens() int {
+	return (c.ascii+3)/4 + c.other
+}
+
+// Fit 计入 s 中不超过 limit 个token的最长前缀；ok 为 false 表示 s 被截断
+func (c *tokenCounter) Fit(s string, limit int) (fit string, ok bool) {
+	for i, r := range s {
+		ascii, other := c.ascii, c.other
+		if r < 128 {
+			ascii++
+		} else {
+			other++
+		}
+		if (ascii+3)/4+other > limit {
+			return s[:i], false
+		}
+		c.ascii, c.other = ascii, other
+	}
+	return s, true
+}
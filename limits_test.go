@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+// discardLogger 测试用的请求日志，丢弃全部输出
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// answerFrame 构造一个 answer 阶段的上游帧
+func answerFrame(delta string) *UpstreamData {
+	data := &UpstreamData{}
+	data.Data.Phase = "answer"
+	data.Data.DeltaContent = delta
+	return data
+}
+
+func TestStopMatcher(t *testing.T) {
+	tests := []struct {
+		name        string
+		stops       []string
+		deltas      []string
+		want        string
+		wantMatched string
+	}{
+		{
+			name:        "stop in one delta",
+			stops:       []string{"END"},
+			deltas:      []string{"hello END world"},
+			want:        "hello ",
+			wantMatched: "END",
+		},
+		{
+			name:        "stop split across deltas",
+			stops:       []string{"END"},
+			deltas:      []string{"hello E", "N", "D world"},
+			want:        "hello ",
+			wantMatched: "END",
+		},
+		{
+			name:   "held prefix flushed on final",
+			stops:  []string{"END"},
+			deltas: []string{"hello E", "N"},
+			want:   "hello EN",
+		},
+		{
+			name:   "held prefix released when it stops matching",
+			stops:  []string{"END"},
+			deltas: []string{"hello E", "x"},
+			want:   "hello Ex",
+		},
+		{
+			name:        "earliest of multiple stops wins",
+			stops:       []string{"world", "lo"},
+			deltas:      []string{"hello world"},
+			want:        "hel",
+			wantMatched: "lo",
+		},
+		{
+			name:        "earliest stop wins across deltas",
+			stops:       []string{"BBB", "AA"},
+			deltas:      []string{"x B", "BAA BBB"},
+			want:        "x BB",
+			wantMatched: "AA",
+		},
+		{
+			name:        "multibyte stop split inside a rune",
+			stops:       []string{"。"},
+			deltas:      []string{"你好\xe3\x80", "\x82再见"},
+			want:        "你好",
+			wantMatched: "。",
+		},
+		{
+			name:        "nothing after hit",
+			stops:       []string{"#"},
+			deltas:      []string{"a#b", "c"},
+			want:        "a",
+			wantMatched: "#",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &stopMatcher{stops: tt.stops}
+			var got string
+			for _, d := range tt.deltas {
+				got += m.Feed(d, false)
+			}
+			got += m.Feed("", true)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if m.Hit() != (tt.wantMatched != "") || m.Matched() != tt.wantMatched {
+				t.Errorf("hit %v matched %q, want %q", m.Hit(), m.Matched(), tt.wantMatched)
+			}
+		})
+	}
+}
+
+func TestTokenCounterFit(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		limit  int
+		want   []string
+		wantOK bool
+	}{
+		{"ascii within limit", []string{"abcdefgh"}, 2, []string{"abcdefgh"}, true},
+		{"ascii cut", []string{"abcdefghi"}, 2, []string{"abcdefgh"}, false},
+		{"cjk cut", []string{"你好世界"}, 3, []string{"你好世"}, false},
+		{"mixed fits", []string{"ab中文cd"}, 3, []string{"ab中文cd"}, true},
+		{"mixed cut on ascii", []string{"ab中文cde"}, 3, []string{"ab中文cd"}, false},
+		{"mixed cut on cjk", []string{"abcd中文"}, 2, []string{"abcd中"}, false},
+		{"counted across chunks", []string{"abcd", "你好", "e"}, 3, []string{"abcd", "你好", ""}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c tokenCounter
+			ok := true
+			for i, chunk := range tt.chunks {
+				var fit string
+				fit, ok = c.Fit(chunk, tt.limit)
+				if fit != tt.want[i] {
+					t.Errorf("chunk %d: got %q, want %q", i, fit, tt.want[i])
+				}
+				if !ok {
+					break
+				}
+			}
+			if ok != tt.wantOK {
+				t.Errorf("ok %v, want %v", ok, tt.wantOK)
+			}
+			if c.Tokens() > tt.limit {
+				t.Errorf("counted %d tokens, limit %d", c.Tokens(), tt.limit)
+			}
+		})
+	}
+}
+
+func TestAssemblerLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		stops      []string
+		maxTokens  int
+		frames     []string
+		want       string
+		wantReason string
+		wantStop   string
+	}{
+		{
+			name:       "no limits",
+			frames:     []string{"hello ", "世界"},
+			want:       "hello 世界",
+			wantReason: "stop",
+		},
+		{
+			name:       "max_tokens on mixed text",
+			maxTokens:  3,
+			frames:     []string{"ab中", "文cde"},
+			want:       "ab中文cd",
+			wantReason: "length",
+		},
+		{
+			name:       "max_tokens exactly reached",
+			maxTokens:  3,
+			frames:     []string{"ab中", "文cd"},
+			want:       "ab中文cd",
+			wantReason: "stop",
+		},
+		{
+			name:       "stop sequence split across frames",
+			stops:      []string{"。结束"},
+			frames:     []string{"你好。", "结", "束后面"},
+			want:       "你好",
+			wantReason: "stop",
+			wantStop:   "。结束",
+		},
+		{
+			name:       "held stop prefix flushed at finish",
+			stops:      []string{"STOP"},
+			frames:     []string{"abc ST"},
+			want:       "abc ST",
+			wantReason: "stop",
+		},
+		{
+			name:       "stop before max_tokens",
+			stops:      []string{"x"},
+			maxTokens:  100,
+			frames:     []string{"中文x中文"},
+			want:       "中文",
+			wantReason: "stop",
+			wantStop:   "x",
+		},
+		{
+			name:       "max_tokens before stop",
+			stops:      []string{"x"},
+			maxTokens:  1,
+			frames:     []string{"中文x"},
+			want:       "中",
+			wantReason: "length",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asm := newResponseAssembler("strip", nil, nil, discardLogger)
+			asm.SetLimits(tt.stops, tt.maxTokens)
+			var got string
+			for _, f := range tt.frames {
+				d, done := asm.Feed(answerFrame(f))
+				got += d.Content
+				if done {
+					break
+				}
+			}
+			got += asm.Finish().Content
+			if got != tt.want || asm.Content() != tt.want {
+				t.Errorf("got %q (content %q), want %q", got, asm.Content(), tt.want)
+			}
+			if asm.FinishReason() != tt.wantReason {
+				t.Errorf("finish_reason %q, want %q", asm.FinishReason(), tt.wantReason)
+			}
+			if asm.StopSequence() != tt.wantStop {
+				t.Errorf("stop sequence %q, want %q", asm.StopSequence(), tt.wantStop)
+			}
+		})
+	}
+}
+
+func TestParseStop(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{``, nil, false},
+		{`null`, nil, false},
+		{`""`, nil, false},
+		{`"END"`, []string{"END"}, false},
+		{`["a","","b"]`, []string{"a", "b"}, false},
+		{`["a","b","c","d","e"]`, nil, true},
+		{`42`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := parseStop(json.RawMessage(tt.raw))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 始终脱敏的日志字段（不区分大小写）
+var secretLogKeys = map[string]bool{
+	"authorization": true,
+	"x-api-key":     true,
+	"api_key":       true,
+	"token":         true,
+	"auth_token":    true,
+	"cookie":        true,
+}
+
+// 消息内容字段，LOG_MESSAGE_CONTENT=false 时只记录长度
+var contentLogKeys = map[string]bool{
+	"content":   true,
+	"reasoning": true,
+	"body":      true,
+	"data":      true,
+}
+
+// initLogger 按 LOG_LEVEL、LOG_FORMAT 初始化全局 slog，标准库 log 的输出也写入 slog
+func initLogger() {
+	level := slog.LevelInfo
+	if config().DebugMode {
+		level = slog.LevelDebug
+	}
+	if config().LogLevel != "" {
+		if err := level.UnmarshalText([]byte(config().LogLevel)); err != nil {
+			fmt.Fprintf(os.Stderr, "无效的LOG_LEVEL %q，使用 %s\n", config().LogLevel, level)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactLogAttr}
+	var handler slog.Handler
+	if strings.EqualFold(config().LogFormat, "text") {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// redactLogAttr 脱敏 token/Authorization 等字段；未开启 LOG_MESSAGE_CONTENT 时消息内容只保留长度
+func redactLogAttr(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	switch {
+	case secretLogKeys[key]:
+		if s, ok := a.Value.Any().(string); ok && s != "" {
+			return slog.String(a.Key, maskToken(s))
+		}
+		return slog.String(a.Key, "***")
+	case contentLogKeys[key] && !config().LogMessageContent:
+		if s, ok := a.Value.Any().(string); ok {
+			return slog.String(a.Key, fmt.Sprintf("[redacted %d bytes]", len(s)))
+		}
+		return slog.String(a.Key, "[redacted]")
+	}
+	return a
+}
+
+type requestIDKey struct{}
+
+// withRequestID 为每个请求分配ID：沿用客户端传入的合法 X-Request-ID，否则生成新的，并在响应头中返回
+func withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// validRequestID 只接受不超过128个字符的字母、数字与 -_.:，避免日志注入
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID 返回 context 中的请求ID
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logger 返回带请求ID的日志记录器；请求处于trace中时附带 trace_id、span_id
+func logger(ctx context.Context) *slog.Logger {
+	l := slog.Default()
+	if id := requestID(ctx); id != "" {
+		l = l.With("request_id", id)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		l = l.With("trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+	}
+	return l
+}
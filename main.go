@@ -3,72 +3,27 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"regexp"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
-)
 
-// Config 配置结构体
-type Config struct {
-	UpstreamUrl       string
-	DefaultKey        string
-	UpstreamToken     string
-	DefaultModelName  string
-	ThinkingModelName string
-	SearchModelName   string
-	Port              string
-	DebugMode         bool
-	ThinkTagsMode     string // strip: 去除<details>标签；think: 转为<think>标签；raw: 保留原样
-	AnonTokenEnabled  bool
-}
-
-// 全局配置变量
-var config Config
-
-// initConfig 初始化配置
-func initConfig() {
-	// 从环境变量读取配置，如果没有设置则使用默认值
-	config.UpstreamUrl = getEnv("UPSTREAM_URL", "https://chat.z.ai/api/chat/completions")
-	config.DefaultKey = getEnv("DEFAULT_KEY", "sk-123456")
-	config.UpstreamToken = getEnv("UPSTREAM_TOKEN", "eyJ...") // 上游API的token（回退用）
-	config.DefaultModelName = getEnv("DEFAULT_MODEL_NAME", "GLM-4.5")
-	config.ThinkingModelName = getEnv("THINKING_MODEL_NAME", "GLM-4.5-Thinking")
-	config.SearchModelName = getEnv("SEARCH_MODEL_NAME", "GLM-4.5-Search")
-	config.Port = getEnv("PORT", ":3007")
-	config.DebugMode = getBoolEnv("DEBUG_MODE", true)
-	config.ThinkTagsMode = getEnv("THINK_TAGS_MODE", "think")
-	config.AnonTokenEnabled = getBoolEnv("ANON_TOKEN_ENABLED", true)
-}
-
-// getEnv 获取环境变量，如果不存在则返回默认值
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
-
-// getBoolEnv 获取布尔型环境变量
-func getBoolEnv(key string, defaultValue bool) bool {
-	if value := os.Getenv(key); value != "" {
-		boolValue, err := strconv.ParseBool(value)
-		if err == nil {
-			return boolValue
-		}
-	}
-	return defaultValue
-}
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
 
 // 伪装前端头部（来自抓包）
 const (
-	XFeVersion  = "prod-fe-1.0.70"
+	XFeVersion  = "prod-fe-1.0.70" // 默认值，可通过 FE_VERSION 覆盖
 	BrowserUa   = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/139.0.0.0 Safari/537.36 Edg/139.0.0.0"
 	SecChUa     = "\"Not;A=Brand\";v=\"99\", \"Microsoft Edge\";v=\"139\", \"Chromium\";v=\"139\""
 	SecChUaMob  = "?0"
@@ -78,18 +33,34 @@ const (
 
 // OpenAIRequest OpenAI 请求结构
 type OpenAIRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Stream      bool      `json:"stream,omitempty"`
-	Temperature float64   `json:"temperature,omitempty"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
+	Model               string          `json:"model"`
+	Messages            []Message       `json:"messages"`
+	Stream              bool            `json:"stream,omitempty"`
+	Temperature         float64         `json:"temperature,omitempty"`
+	MaxTokens           int             `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int             `json:"max_completion_tokens,omitempty"` // 新版参数名，优先于 max_tokens
+	Stop                json.RawMessage `json:"stop,omitempty"`                  // 字符串或字符串数组
+	Tools               []Tool          `json:"tools,omitempty"`
+	ToolChoice          json.RawMessage `json:"tool_choice,omitempty"`
+	StreamOptions       *StreamOptions  `json:"stream_options,omitempty"`
+	ResponseFormat      *ResponseFormat `json:"response_format,omitempty"`
+}
+
+// StreamOptions 流式选项
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"` // 流结束前额外发送一个带 usage 的chunk
 }
 
 // Message 消息结构
 type Message struct {
-	Role             string `json:"role"`
-	Content          string `json:"content"`
-	ReasoningContent string `json:"reasoning_content,omitempty"`
+	Role             string     `json:"role"`
+	Content          string     `json:"content"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	Name             string     `json:"name,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID       string     `json:"tool_call_id,omitempty"`
+	// Parts 多模态请求的原始内容片段，文本部分已拼接到 Content
+	Parts []ContentPart `json:"-"`
 }
 
 // UpstreamRequest 上游请求结构
@@ -110,16 +81,18 @@ type UpstreamRequest struct {
 	} `json:"model_item,omitempty"`
 	ToolServers []string          `json:"tool_servers,omitempty"`
 	Variables   map[string]string `json:"variables,omitempty"`
+	Files       []UpstreamFile    `json:"files,omitempty"`
 }
 
 // OpenAIResponse OpenAI 响应结构
 type OpenAIResponse struct {
-	ID      string   `json:"id"`
-	Object  string   `json:"object"`
-	Created int64    `json:"created"`
-	Model   string   `json:"model"`
-	Choices []Choice `json:"choices"`
-	Usage   Usage    `json:"usage,omitempty"`
+	ID       string            `json:"id"`
+	Object   string            `json:"object"`
+	Created  int64             `json:"created"`
+	Model    string            `json:"model"`
+	Choices  []Choice          `json:"choices"`
+	Usage    *Usage            `json:"usage,omitempty"`
+	Metadata *ResponseMetadata `json:"metadata,omitempty"` // 流式响应续写标记
 }
 
 // Choice 选择结构
@@ -132,33 +105,68 @@ type Choice struct {
 
 // Delta 增量结构
 type Delta struct {
-	Role             string `json:"role,omitempty"`
-	Content          string `json:"content,omitempty"`
-	ReasoningContent string `json:"reasoning_content,omitempty"`
+	Role             string     `json:"role,omitempty"`
+	Content          string     `json:"content,omitempty"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
 }
 
 // Usage 用量结构
 type Usage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens            int                      `json:"prompt_tokens"`
+	CompletionTokens        int                      `json:"completion_tokens"`
+	TotalTokens             int                      `json:"total_tokens"`
+	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details,omitempty"`
+}
+
+// CompletionTokensDetails 输出token明细
+type CompletionTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"` // 思考阶段的token数
+}
+
+// estimateTokens 粗略估算文本的token数（上游未返回用量时使用）
+// 英文约4个字符一个token，中日韩等字符约一个字一个token
+func estimateTokens(s string) int {
+	var c tokenCounter
+	for _, r := range s {
+		if r < 128 {
+			c.ascii++
+		} else {
+			c.other++
+		}
+	}
+	return c.Tokens()
+}
+
+// estimateUsage 根据请求消息与输出文本估算用量
+func estimateUsage(messages []Message, completion string) Usage {
+	prompt := 0
+	for _, m := range messages {
+		prompt += estimateTokens(m.Content) + 4
+	}
+	completionTokens := estimateTokens(completion)
+	return Usage{
+		PromptTokens:     prompt,
+		CompletionTokens: completionTokens,
+		TotalTokens:      prompt + completionTokens,
+	}
 }
 
 // UpstreamData 上游SSE响应结构
 type UpstreamData struct {
-    Type string `json:"type"`
-    Data struct {
-        DeltaContent string         `json:"delta_content"`
-        EditContent  string         `json:"edit_content"`
-        Phase        string         `json:"phase"`
-        Done         bool           `json:"done"`
-        Usage        Usage          `json:"usage,omitempty"`
-        Error        *UpstreamError `json:"error,omitempty"`
-        Inner        *struct {
-            Error *UpstreamError `json:"error,omitempty"`
-        } `json:"data,omitempty"`
-    } `json:"data"`
-    Error *UpstreamError `json:"error,omitempty"`
+	Type string `json:"type"`
+	Data struct {
+		DeltaContent string         `json:"delta_content"`
+		EditContent  string         `json:"edit_content"`
+		Phase        string         `json:"phase"`
+		Done         bool           `json:"done"`
+		Usage        Usage          `json:"usage,omitempty"`
+		Error        *UpstreamError `json:"error,omitempty"`
+		Inner        *struct {
+			Error *UpstreamError `json:"error,omitempty"`
+		} `json:"data,omitempty"`
+	} `json:"data"`
+	Error *UpstreamError `json:"error,omitempty"`
 }
 
 // UpstreamError 上游错误结构
@@ -167,6 +175,20 @@ type UpstreamError struct {
 	Code   int    `json:"code"`
 }
 
+// upstreamError 返回帧中携带的上游错误（data.error 或 data.data.error 或 顶层error），没有时返回 nil
+func (u *UpstreamData) upstreamError() *UpstreamError {
+	if u.Error != nil {
+		return u.Error
+	}
+	if u.Data.Error != nil {
+		return u.Data.Error
+	}
+	if u.Data.Inner != nil {
+		return u.Data.Inner.Error
+	}
+	return nil
+}
+
 // ModelsResponse 模型列表响应
 type ModelsResponse struct {
 	Object string  `json:"object"`
@@ -181,17 +203,26 @@ type Model struct {
 	OwnedBy string `json:"owned_by"`
 }
 
-// debug日志函数
+// debugLog 输出不属于具体请求的调试日志；请求处理中使用 logger(ctx) 输出带请求ID的结构化日志
 func debugLog(format string, args ...interface{}) {
-	if config.DebugMode {
-		log.Printf("[DEBUG] "+format, args...)
-	}
+	slog.Debug(fmt.Sprintf(format, args...))
 }
 
 // 获取匿名token（每次对话使用不同token，避免共享记忆）
-func getAnonymousToken() (string, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest("GET", OriginBase+"/api/v1/auths/", nil)
+func getAnonymousToken(ctx context.Context) (token string, err error) {
+	ctx, span := tracer.Start(ctx, "anon_token.fetch")
+	start := time.Now()
+	defer func() {
+		endSpan(span, err)
+		metricAnonFetchLatency.ObserveSince(start)
+		if err != nil {
+			metricAnonFetches.Inc("failure")
+		} else {
+			metricAnonFetches.Inc("success")
+		}
+	}()
+	client := &http.Client{Transport: upstreamTransport, Timeout: 10 * time.Second}
+	req, err := http.NewRequestWithContext(ctx, "GET", OriginBase+"/api/v1/auths/", nil)
 	if err != nil {
 		return "", err
 	}
@@ -199,7 +230,7 @@ func getAnonymousToken() (string, error) {
 	req.Header.Set("User-Agent", BrowserUa)
 	req.Header.Set("Accept", "*/*")
 	req.Header.Set("Accept-Language", "zh-CN,zh;q=0.9")
-	req.Header.Set("X-FE-Version", XFeVersion)
+	req.Header.Set("X-FE-Version", config().FEVersion)
 	req.Header.Set("sec-ch-ua", SecChUa)
 	req.Header.Set("sec-ch-ua-mobile", SecChUaMob)
 	req.Header.Set("sec-ch-ua-platform", SecChUaPlat)
@@ -227,18 +258,79 @@ func getAnonymousToken() (string, error) {
 }
 
 func main() {
-	// 初始化配置
-	initConfig()
-	
-	http.HandleFunc("/v1/models", handleModels)
-	http.HandleFunc("/v1/chat/completions", handleChatCompletions)
-	http.HandleFunc("/", handleOptions)
+	// 初始化配置，任何无效的配置项都拒绝启动
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "配置无效:\n%v\n", err)
+		os.Exit(1)
+	}
+	currentConfig.Store(cfg)
+	initLogger()
+	shutdownTracing := initTracing()
+	initUpstreamClient()
+	specs, err := loadTokenSpecs(cfg)
+	if err != nil {
+		slog.Error("加载上游token失败", "error", err)
+		os.Exit(1)
+	}
+	upstreamPool = newTokenPool(specs, cfg.TokenPoolStrategy, cfg.TokenCooldownBase, cfg.TokenCooldownMax)
+	if apiKeys, err = newKeyStore(cfg); err != nil {
+		slog.Error("加载API key失败", "error", err)
+		os.Exit(1)
+	}
+	if models, err = newModelRegistry(cfg); err != nil {
+		slog.Error("加载模型注册表失败", "error", err)
+		os.Exit(1)
+	}
+
+	// 收到 SIGHUP 或配置文件变化时重新加载配置
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if err := reloadConfig(); err != nil {
+				slog.Error("重新加载配置失败，继续使用当前配置", "error", err)
+			}
+		}
+	}()
+	if cfg.ConfigWatchInterval > 0 && len(cfg.watchedFiles()) > 0 {
+		go watchConfigFiles(cfg.ConfigWatchInterval)
+	}
 
-	log.Printf("OpenAI兼容API服务器启动在端口%s", config.Port)
-	log.Printf("默认模型: %s", config.DefaultModelName)
-	log.Printf("上游: %s", config.UpstreamUrl)
-	log.Printf("Debug模式: %v", config.DebugMode)
-	log.Fatal(http.ListenAndServe(config.Port, nil))
+	// 退出前导出尚未发送的span
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-stop
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("导出span失败", "error", err)
+		}
+		os.Exit(0)
+	}()
+
+	http.HandleFunc("/v1/models", withRequestID(withTracing(handleModels)))
+	http.HandleFunc("/v1/chat/completions", withRequestID(withTracing(handleChatCompletions)))
+	http.HandleFunc("/v1/messages", withRequestID(withTracing(handleMessages)))
+	http.HandleFunc("/admin/tokens", withRequestID(handleAdminTokens))
+	http.HandleFunc("/admin/keys/reload", withRequestID(handleAdminKeysReload))
+	http.HandleFunc("/admin/stats", withRequestID(handleAdminStats))
+	http.HandleFunc("/metrics", handleMetrics)
+	http.HandleFunc("/", withRequestID(handleOptions))
+
+	slog.Info("OpenAI兼容API服务器启动",
+		"config_file", cfg.File,
+		"port", config().Port,
+		"default_model", models.Default().ID,
+		"models", len(models.List()),
+		"upstream", config().UpstreamUrl,
+		"token_pool", upstreamPool.Size(),
+		"token_strategy", config().TokenPoolStrategy,
+		"debug", config().DebugMode)
+	err = http.ListenAndServe(config().Port, nil)
+	slog.Error("服务器退出", "error", err)
+	os.Exit(1)
 }
 
 func handleOptions(w http.ResponseWriter, r *http.Request) {
@@ -247,127 +339,208 @@ func handleOptions(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	w.WriteHeader(http.StatusNotFound)
+	writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "unknown_url",
+		fmt.Sprintf("Unknown request URL: %s %s", r.Method, r.URL.Path))
+}
+
+// writeOpenAIError 以OpenAI错误对象格式返回错误
+func writeOpenAIError(w http.ResponseWriter, status int, errType string, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errType,
+			"code":    code,
+			"param":   nil,
+		},
+	})
 }
 
 func setCORSHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, x-api-key, anthropic-version")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 }
 
-func handleModels(w http.ResponseWriter, r *http.Request) {
+func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 	setCORSHeaders(w)
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	response := ModelsResponse{
-		Object: "list",
-		Data: []Model{
-			{
-				ID:      config.DefaultModelName,
-				Object:  "model",
-				Created: time.Now().Unix(),
-				OwnedBy: "z.ai",
-			},
-			{
-				ID:      config.ThinkingModelName,
-				Object:  "model",
-				Created: time.Now().Unix(),
-				OwnedBy: "z.ai",
-			},
-			{
-				ID:      config.SearchModelName,
-				Object:  "model",
-				Created: time.Now().Unix(),
-				OwnedBy: "z.ai",
-			},
-		},
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "Method not allowed")
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
+	reqLog := logger(r.Context())
+	reqLog.Debug("收到chat completions请求")
+	metrics := trackRequest(w, r)
+	defer metrics.Done()
+	w = metrics
 
-func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
+	// 验证API Key
+	_, authSpan := tracer.Start(r.Context(), "auth")
+	key := authenticateRequest(w, r)
+	authSpan.End()
+	if key == nil {
 		return
 	}
+	metrics.Key = key.Name
 
-	debugLog("收到chat completions请求")
+	// 解析请求
+	var req OpenAIRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		reqLog.Info("JSON解析失败", "error", err)
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "Invalid JSON body: "+err.Error())
+		return
+	}
 
-	// 验证API Key
-	authHeader := r.Header.Get("Authorization")
-	if !strings.HasPrefix(authHeader, "Bearer ") {
-		debugLog("缺少或无效的Authorization头")
-		http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
+	reqLog.Debug("请求解析成功", "model", req.Model, "stream", req.Stream, "messages", len(req.Messages), "tools", len(req.Tools))
+
+	structured, err := parseResponseFormat(req.ResponseFormat)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_response_format", err.Error())
+		return
+	}
+	stops, err := parseStop(req.Stop)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_stop", err.Error())
+		return
+	}
+	maxTokens := req.MaxTokens
+	if req.MaxCompletionTokens > 0 {
+		maxTokens = req.MaxCompletionTokens
+	}
+
+	model, ok := models.Resolve(req.Model)
+	if !ok {
+		reqLog.Debug("未知模型，使用默认模型", "requested", req.Model, "model", model.ID)
+	}
+	metrics.Model = model.ID
+
+	// 只有支持视觉的模型可以接收图片，文本模型只使用拼接后的文本
+	if messagesHaveImages(req.Messages) && !model.Vision {
+		reqLog.Info("模型不支持图片输入", "model", model.ID)
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "model_not_vision_capable",
+			fmt.Sprintf("The model `%s` does not support image input", model.ID))
 		return
 	}
 
-	apiKey := strings.TrimPrefix(authHeader, "Bearer ")
-	if apiKey != config.DefaultKey {
-		debugLog("无效的API key: %s", apiKey)
-		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+	// 模型权限与配额检查
+	if kerr := apiKeys.Admit(key, model); kerr != nil {
+		reqLog.Info("key请求被拒绝", "key", key.Name, "reason", kerr.Message)
+		writeKeyError(w, kerr)
 		return
 	}
 
-	debugLog("API key验证通过")
+	// 工具定义注入提示词，tool 结果转换为普通消息
+	messages := prepareToolMessages(req.Messages, req.Tools, req.ToolChoice)
+	if structured != nil {
+		// 结构化输出：在系统提示中说明JSON格式要求
+		messages = appendSystemPrompt(messages, structured.Prompt())
+	}
 
-	// 解析请求
-	var req OpenAIRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		debugLog("JSON解析失败: %v", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	upstreamReq := buildUpstreamRequest(model, messages)
+	authToken, fail := selectAuthToken(r.Context())
+	if fail != nil {
+		fail.write(w)
 		return
 	}
+	sess := &chatSession{
+		ChatID:        upstreamReq.ChatID,
+		AuthToken:     authToken,
+		Model:         model.ID,
+		ThinkTagsMode: config().ThinkTagsMode,
+		IncludeUsage:  req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+		Stop:          stops,
+		MaxTokens:     maxTokens,
+		Metrics:       metrics,
+		Log:           logger(r.Context()),
+	}
+	// 思考标签策略优先级：key强制 > 模型默认 > 全局配置
+	if key.ThinkTagsMode != "" {
+		sess.ThinkTagsMode = key.ThinkTagsMode
+	} else if model.ThinkTagsMode != "" {
+		sess.ThinkTagsMode = model.ThinkTagsMode
+	}
+	// 重试时可能换用新token，释放最终使用的那个
+	defer func() { upstreamPool.Release(sess.AuthToken) }()
+	if err := uploadMessageImages(r.Context(), &upstreamReq, sess.AuthToken); err != nil {
+		writeOpenAIError(w, err.Status, err.Type, err.Code, err.Message)
+		return
+	}
+	if mode, _ := parseToolChoice(req.ToolChoice); len(req.Tools) > 0 && mode != "none" {
+		sess.ToolParser = newToolCallParser(sess.Log)
+	}
 
-	debugLog("请求解析成功 - 模型: %s, 流式: %v, 消息数: %d", req.Model, req.Stream, len(req.Messages))
+	// 调用上游API
+	// 上游请求与下游连接绑定，客户端断开时取消上游请求
+	var usage Usage
+	if structured != nil {
+		usage = handleStructuredResponse(r.Context(), w, upstreamReq, sess, structured, req.Stream)
+	} else if req.Stream {
+		usage = handleStreamResponseWithIDs(r.Context(), w, upstreamReq, sess)
+	} else {
+		usage = handleNonStreamResponseWithIDs(r.Context(), w, upstreamReq, sess)
+	}
+	apiKeys.RecordTokens(key, usage.TotalTokens)
+	recordTokenMetrics(model.ID, usage)
+}
+
+// chatSession 单次对话请求的上下文
+type chatSession struct {
+	ChatID        string
+	AuthToken     string
+	Model         string          // 返回给客户端的模型ID
+	ThinkTagsMode string          // 本次请求的思考标签处理策略（key可强制指定）
+	ToolParser    *toolCallParser // 请求带 tools 时用于从输出中解析工具调用
+	IncludeUsage  bool            // stream_options.include_usage
+	Stop          []string        // 停止序列
+	MaxTokens     int             // 输出token上限，0 表示不限
+	Metrics       *requestMetrics // 记录首token延迟
+	Log           *slog.Logger    // 本次请求的日志，带请求ID与trace ID
+}
+
+// newAssembler 按本次请求的思考标签策略、工具与输出限制创建组装器
+func (s *chatSession) newAssembler(messages []Message) *responseAssembler {
+	asm := newResponseAssembler(s.ThinkTagsMode, s.ToolParser, messages, s.Log.With("chat_id", s.ChatID))
+	asm.SetLimits(s.Stop, s.MaxTokens)
+	if s.Metrics != nil {
+		asm.OnFirstToken(s.Metrics.FirstToken)
+	}
+	return asm
+}
 
+// buildUpstreamRequest 根据注册表中的模型与消息构造上游请求
+func buildUpstreamRequest(model *ModelConfig, messages []Message) UpstreamRequest {
 	// 生成会话相关ID
 	chatID := fmt.Sprintf("%d-%d", time.Now().UnixNano(), time.Now().Unix())
 	msgID := fmt.Sprintf("%d", time.Now().UnixNano())
 
-	var isThing bool
-	var isSearch bool
-	var searchMcp string
-	if req.Model == config.ThinkingModelName {
-		isThing = true
-	} else if req.Model == config.SearchModelName {
-		isThing = true
-		isSearch = true
-		searchMcp = "deep-web-search"
-	}
-
 	// 构造上游请求
-	upstreamReq := UpstreamRequest{
+	return UpstreamRequest{
 		Stream:   true, // 总是使用流式从上游获取
 		ChatID:   chatID,
 		ID:       msgID,
-		Model:    "0727-360B-API", // 上游实际模型ID
-		Messages: req.Messages,
+		Model:    model.UpstreamID, // 上游实际模型ID
+		Messages: messages,
 		Params:   map[string]interface{}{},
-		Features: map[string]interface{}{
-			"enable_thinking": isThing,
-			"web_search":      isSearch,
-			"auto_web_search": isSearch,
-		},
+		Features: model.upstreamFeatures(),
 		BackgroundTasks: map[string]bool{
 			"title_generation": false,
 			"tags_generation":  false,
 		},
-		MCPServers: []string{
-			searchMcp,
-		},
+		MCPServers: append([]string{}, model.MCPServers...),
 		ModelItem: struct {
 			ID      string `json:"id"`
 			Name    string `json:"name"`
 			OwnedBy string `json:"owned_by"`
-		}{ID: "0727-360B-API", Name: "GLM-4.5", OwnedBy: "openai"},
+		}{ID: model.UpstreamID, Name: model.Name, OwnedBy: "openai"},
 		ToolServers: []string{},
 		Variables: map[string]string{
 			"{{USER_NAME}}":        "User",
@@ -375,44 +548,75 @@ func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 			"{{CURRENT_DATETIME}}": time.Now().Format("2006-01-02 15:04:05"),
 		},
 	}
+}
 
-	// 选择本次对话使用的token
-	authToken := config.UpstreamToken
-	if config.AnonTokenEnabled {
-		if t, err := getAnonymousToken(); err == nil {
-			authToken = t
-			debugLog("匿名token获取成功: %s...", func() string {
-				if len(t) > 10 {
-					return t[:10]
+// selectAuthToken 选择本次对话使用的token：优先匿名token，获取失败时按退避重试，仍失败再从令牌池选取；
+// ANON_TOKEN_STRICT 开启时不回退共享token，返回503失败。
+// 使用完毕后需调用 upstreamPool.Release 释放
+func selectAuthToken(ctx context.Context) (string, *upstreamFailure) {
+	if config().AnonTokenEnabled {
+		for attempt := 0; ; attempt++ {
+			t, err := getAnonymousToken(ctx)
+			if err == nil {
+				logger(ctx).Debug("匿名token获取成功", "token", t)
+				return t, nil
+			}
+			if attempt >= config().UpstreamRetries {
+				if config().AnonTokenStrict {
+					logger(ctx).Warn("匿名token获取失败，严格模式不回退共享token", "error", err)
+					return "", anonTokenFailure()
 				}
-				return t
-			}())
-		} else {
-			debugLog("匿名token获取失败，回退固定token: %v", err)
+				logger(ctx).Warn("匿名token获取失败，回退令牌池", "error", err)
+				break
+			}
+			delay := retryDelay(attempt)
+			logger(ctx).Debug("匿名token获取失败，稍后重试", "delay", delay, "retry", attempt+1, "error", err)
+			upstreamRetries.Inc("anon_token")
+			if !sleepContext(ctx, delay) {
+				if config().AnonTokenStrict {
+					return "", upstreamCallFailure(ctx, "", ctx.Err())
+				}
+				break
+			}
 		}
 	}
-
-	// 调用上游API
-	if req.Stream {
-		handleStreamResponseWithIDs(w, upstreamReq, chatID, authToken)
-	} else {
-		handleNonStreamResponseWithIDs(w, upstreamReq, chatID, authToken)
+	if t, ok := upstreamPool.Acquire(); ok {
+		return t, nil
 	}
+	return config().UpstreamToken, nil
+}
+
+// anonTokenFailure ANON_TOKEN_STRICT 开启且无法获得匿名token时的失败，不回退共享token
+func anonTokenFailure() *upstreamFailure {
+	return &upstreamFailure{outcomeUpstreamError, http.StatusServiceUnavailable, "api_error", "anon_token_unavailable",
+		"No anonymous upstream token is available, please retry later"}
 }
 
-func callUpstreamWithHeaders(upstreamReq UpstreamRequest, refererChatID string, authToken string) (*http.Response, error) {
+func callUpstreamWithHeaders(ctx context.Context, upstreamReq UpstreamRequest, refererChatID string, authToken string) (resp *http.Response, err error) {
+	ctx, span := tracer.Start(ctx, "upstream.request", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("upstream.model", upstreamReq.Model), attribute.String("chat.id", refererChatID)))
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+			if resp.StatusCode >= 400 {
+				span.SetStatus(codes.Error, resp.Status)
+			}
+		}
+		endSpan(span, err)
+	}()
+	reqLog := logger(ctx)
 	reqBody, err := json.Marshal(upstreamReq)
 	if err != nil {
-		debugLog("上游请求序列化失败: %v", err)
+		reqLog.Error("上游请求序列化失败", "error", err)
 		return nil, err
 	}
 
-	debugLog("调用上游API: %s", config.UpstreamUrl)
-	debugLog("上游请求体: %s", string(reqBody))
+	// 请求体含用户消息，只在开启 LOG_MESSAGE_CONTENT 时输出原文
+	reqLog.Debug("调用上游API", "url", config().UpstreamUrl, "chat_id", refererChatID, "token", authToken, "body", string(reqBody))
 
-	req, err := http.NewRequest("POST", config.UpstreamUrl, bytes.NewBuffer(reqBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", config().UpstreamUrl, bytes.NewBuffer(reqBody))
 	if err != nil {
-		debugLog("创建HTTP请求失败: %v", err)
+		reqLog.Error("创建HTTP请求失败", "error", err)
 		return nil, err
 	}
 
@@ -424,283 +628,382 @@ func callUpstreamWithHeaders(upstreamReq UpstreamRequest, refererChatID string,
 	req.Header.Set("sec-ch-ua", SecChUa)
 	req.Header.Set("sec-ch-ua-mobile", SecChUaMob)
 	req.Header.Set("sec-ch-ua-platform", SecChUaPlat)
-	req.Header.Set("X-FE-Version", XFeVersion)
+	req.Header.Set("X-FE-Version", config().FEVersion)
 	req.Header.Set("Origin", OriginBase)
 	req.Header.Set("Referer", OriginBase+"/c/"+refererChatID)
 
-	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(req)
+	resp, err = upstreamClient.Do(req)
 	if err != nil {
-		debugLog("上游请求失败: %v", err)
+		reqLog.Warn("上游请求失败", "error", err)
+		metricUpstreamResponses.Inc("error")
 		return nil, err
 	}
 
-	debugLog("上游响应状态: %d %s", resp.StatusCode, resp.Status)
+	reqLog.Debug("上游响应", "status", resp.StatusCode)
+	metricUpstreamResponses.Inc(strconv.Itoa(resp.StatusCode))
+	upstreamPool.Report(authToken, resp.StatusCode)
 	return resp, nil
 }
 
-func handleStreamResponseWithIDs(w http.ResponseWriter, upstreamReq UpstreamRequest, chatID string, authToken string) {
-	debugLog("开始处理流式响应 (chat_id=%s)", chatID)
+// handleStreamResponseWithIDs 以 OpenAI chunk 格式流式转发上游响应，返回本次用量
+func handleStreamResponseWithIDs(ctx context.Context, w http.ResponseWriter, upstreamReq UpstreamRequest, sess *chatSession) Usage {
+	return streamUpstream(ctx, upstreamReq, sess, &openAIStreamSink{w: w, sess: sess})
+}
 
-	resp, err := callUpstreamWithHeaders(upstreamReq, chatID, authToken)
-	if err != nil {
-		debugLog("调用上游失败: %v", err)
-		http.Error(w, "Failed to call upstream", http.StatusBadGateway)
-		return
+// openAIStreamSink 以 chat.completion.chunk 格式写出流式响应
+type openAIStreamSink struct {
+	w        http.ResponseWriter
+	sess     *chatSession
+	metadata *ResponseMetadata // 续写后的chunk都带上 metadata.resumed
+	opened   bool
+	gone     bool
+}
+
+func (s *openAIStreamSink) chunk(delta Delta, finishReason string) OpenAIResponse {
+	return OpenAIResponse{
+		ID:       fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
+		Object:   "chat.completion.chunk",
+		Created:  time.Now().Unix(),
+		Model:    s.sess.Model,
+		Choices:  []Choice{{Index: 0, Delta: delta, FinishReason: finishReason}},
+		Metadata: s.metadata,
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		debugLog("上游返回错误状态: %d", resp.StatusCode)
-		// 读取错误响应体
-		if config.DebugMode {
-			body, _ := io.ReadAll(resp.Body)
-			debugLog("上游错误响应: %s", string(body))
-		}
-		http.Error(w, "Upstream error", http.StatusBadGateway)
+// send 写入一个chunk；写入失败说明客户端已断开，之后不再写入
+func (s *openAIStreamSink) send(chunk OpenAIResponse) {
+	if s.gone {
 		return
 	}
-
-	// 用于策略2：总是展示thinking（配合标签处理）
-	transformThinking := func(s string) string {
-		// 去 <summary>…</summary>
-		s = regexp.MustCompile(`(?s)<summary>.*?</summary>`).ReplaceAllString(s, "")
-		// 清理残留自定义标签，如 </thinking>、<Full> 等
-		s = strings.ReplaceAll(s, "</thinking>", "")
-		s = strings.ReplaceAll(s, "<Full>", "")
-		s = strings.ReplaceAll(s, "</Full>", "")
-		s = strings.TrimSpace(s)
-		switch config.ThinkTagsMode {
-		case "think":
-			s = regexp.MustCompile(`<details[^>]*>`).ReplaceAllString(s, "<think>")
-			s = strings.ReplaceAll(s, "</details>", "</think>")
-		case "strip":
-			s = regexp.MustCompile(`<details[^>]*>`).ReplaceAllString(s, "")
-			s = strings.ReplaceAll(s, "</details>", "")
-		}
-		// 处理每行前缀 "> "（包括起始位置）
-		s = strings.TrimPrefix(s, "> ")
-		s = strings.ReplaceAll(s, "\n> ", "\n")
-		return strings.TrimSpace(s)
+	if err := writeSSEChunk(s.w, chunk); err != nil {
+		s.sess.Log.Debug("写入下游失败，客户端可能已断开", "error", err)
+		s.gone = true
 	}
+}
 
+func (s *openAIStreamSink) Open() bool {
 	// 设置SSE头部
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+	s.w.Header().Set("Content-Type", "text/event-stream")
+	s.w.Header().Set("Cache-Control", "no-cache")
+	s.w.Header().Set("Connection", "keep-alive")
+	if _, ok := s.w.(http.Flusher); !ok {
+		writeOpenAIError(s.w, http.StatusInternalServerError, "api_error", "streaming_unsupported", "Streaming unsupported")
+		return false
+	}
+	s.opened = true
+	// 发送第一个chunk（role）
+	s.send(s.chunk(Delta{Role: "assistant"}, ""))
+	return true
+}
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
-		return
+// Delta 思考内容使用 reasoning_content 字段，工具调用以 delta.tool_calls 发送
+func (s *openAIStreamSink) Delta(d assembledDelta) {
+	if d.Reasoning != "" {
+		s.sess.Log.Debug("发送思考内容", "reasoning", d.Reasoning)
+		s.send(s.chunk(Delta{ReasoningContent: d.Reasoning}, ""))
+	}
+	if d.Content != "" {
+		s.sess.Log.Debug("发送普通内容", "content", d.Content)
+		s.send(s.chunk(Delta{Content: d.Content}, ""))
+	}
+	if len(d.ToolCalls) > 0 {
+		s.sess.Log.Debug("发送工具调用", "count", len(d.ToolCalls))
+		s.send(s.chunk(Delta{ToolCalls: d.ToolCalls}, ""))
 	}
+}
 
-	// 发送第一个chunk（role）
-	firstChunk := OpenAIResponse{
-		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
-		Object:  "chat.completion.chunk",
-		Created: time.Now().Unix(),
-		Model:   config.DefaultModelName,
-		Choices: []Choice{
-			{
-				Index: 0,
-				Delta: Delta{Role: "assistant"},
-			},
+func (s *openAIStreamSink) Resumed(count int) {
+	s.metadata = &ResponseMetadata{Resumed: true, ResumeCount: count}
+}
+
+func (s *openAIStreamSink) Close(asm *responseAssembler) {
+	// 发送结束chunk
+	s.send(s.chunk(Delta{}, asm.FinishReason()))
+
+	// stream_options.include_usage：最后单独发送一个 choices 为空、带 usage 的chunk
+	if s.sess.IncludeUsage {
+		usage := asm.Usage()
+		usageChunk := s.chunk(Delta{}, "")
+		usageChunk.Choices = []Choice{}
+		usageChunk.Usage = &usage
+		s.send(usageChunk)
+	}
+
+	// 发送[DONE]
+	if !s.gone {
+		fmt.Fprintf(s.w, "data: [DONE]\n\n")
+		http.NewResponseController(s.w).Flush()
+	}
+}
+
+func (s *openAIStreamSink) Fail(f *upstreamFailure) {
+	if s.opened {
+		f.writeSSE(s.w)
+	} else {
+		f.write(s.w)
+	}
+}
+
+func (s *openAIStreamSink) Gone() bool {
+	return s.gone
+}
+
+// writeSSEChunk 写入并立即刷新一个SSE chunk，返回写入错误（通常是客户端已断开）
+func writeSSEChunk(w http.ResponseWriter, chunk OpenAIResponse) error {
+	data, _ := json.Marshal(chunk)
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+// writeSSEError 在流中发送OpenAI格式的错误事件并结束流
+func writeSSEError(w http.ResponseWriter, errType string, code string, message string) error {
+	data, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errType,
+			"code":    code,
+			"param":   nil,
 		},
+	})
+	if _, err := fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", data); err != nil {
+		return err
 	}
-	writeSSEChunk(w, firstChunk)
-	flusher.Flush()
+	return http.NewResponseController(w).Flush()
+}
 
-	// 读取上游SSE流
-	debugLog("开始读取上游SSE流")
-	scanner := bufio.NewScanner(resp.Body)
-	lineCount := 0
+// handleNonStreamResponseWithIDs 收集上游完整响应后一次性返回，返回本次用量
+func handleNonStreamResponseWithIDs(ctx context.Context, w http.ResponseWriter, upstreamReq UpstreamRequest, sess *chatSession) Usage {
+	logger(ctx).Debug("开始处理非流式响应", "chat_id", sess.ChatID)
 
-	// 标记是否已发送最初的 answer 片段（来自 EditContent）
-	var sentInitialAnswer bool
+	asm, fail := collectUpstream(ctx, upstreamReq, sess)
+	if fail != nil {
+		fail.write(w)
+		return Usage{}
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		lineCount++
+	usage := asm.Usage()
+	_, flush := tracer.Start(ctx, "downstream.flush")
+	writeCompletion(w, sess, asm.Message(), asm.FinishReason(), usage)
+	flush.End()
+	logger(ctx).Debug("非流式响应发送完成", "chat_id", sess.ChatID)
+	requestOutcomes.Inc(outcomeCompleted)
+	return usage
+}
 
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
+// upstreamFailure 收集上游响应失败的原因；客户端已取消时 Status 为 0，不再写响应
+type upstreamFailure struct {
+	Outcome string
+	Status  int
+	Type    string
+	Code    string
+	Message string
+}
 
-		dataStr := strings.TrimPrefix(line, "data: ")
-		if dataStr == "" {
-			continue
-		}
+func (f *upstreamFailure) Error() string {
+	return f.Code + ": " + f.Message
+}
 
-		debugLog("收到SSE数据 (第%d行): %s", lineCount, dataStr)
+// write 记录请求结果并以OpenAI错误格式返回
+func (f *upstreamFailure) write(w http.ResponseWriter) {
+	requestOutcomes.Inc(f.Outcome)
+	if f.Status != 0 {
+		writeOpenAIError(w, f.Status, f.Type, f.Code, f.Message)
+	}
+}
 
-		var upstreamData UpstreamData
-		if err := json.Unmarshal([]byte(dataStr), &upstreamData); err != nil {
-			debugLog("SSE数据解析失败: %v", err)
-			continue
-		}
+// writeSSE 记录请求结果，SSE头部已发送时以错误事件结束流
+func (f *upstreamFailure) writeSSE(w http.ResponseWriter) {
+	requestOutcomes.Inc(f.Outcome)
+	if f.Status != 0 {
+		writeSSEError(w, f.Type, f.Code, f.Message)
+	}
+}
 
-		// 错误检测（data.error 或 data.data.error 或 顶层error）
-		if (upstreamData.Error != nil) || (upstreamData.Data.Error != nil) || (upstreamData.Data.Inner != nil && upstreamData.Data.Inner.Error != nil) {
-			errObj := upstreamData.Error
-			if errObj == nil {
-				errObj = upstreamData.Data.Error
+// openUpstream 调用上游并检查状态码；成功时调用方负责关闭响应体
+//
+// 连接失败与可重试的状态码在向下游发送任何数据之前按退避重试，最多 UPSTREAM_RETRIES 次，
+// 并遵循上游的 Retry-After。每次请求单独限制等待响应头的时间，超时后按连接失败重试。
+// 连接失败、401/403 与5xx重试时换用新的匿名token或池中token并写回 *authToken，
+// 请求引用了已上传的文件时文件属于原token，不换token；429 只在上游给出 Retry-After 时用同一个token等待后重试
+func openUpstream(ctx context.Context, upstreamReq UpstreamRequest, chatID string, authToken *string) (*http.Response, *upstreamFailure) {
+	for attempt := 0; ; attempt++ {
+		attemptCtx, stopWait, cancelAttempt := awaitHeaders(ctx)
+		resp, err := callUpstreamWithHeaders(attemptCtx, upstreamReq, chatID, *authToken)
+		if !stopWait() && err == nil {
+			// 响应头与超时同时到达，响应体已随 attemptCtx 取消
+			resp.Body.Close()
+			resp, err = nil, context.Cause(attemptCtx)
+		}
+		var fail *upstreamFailure
+		var wait time.Duration
+		var reason string
+		var keepToken bool
+		switch {
+		case err != nil:
+			fail = upstreamCallFailure(attemptCtx, chatID, err)
+			cancelAttempt()
+			if ctx.Err() != nil {
+				// 客户端断开或超过首字节/总时长限制，重试没有意义
+				return nil, fail
 			}
-			if errObj == nil && upstreamData.Data.Inner != nil {
-				errObj = upstreamData.Data.Inner.Error
+			reason = "connect_error"
+		case resp.StatusCode != http.StatusOK:
+			fail = upstreamStatusFailure(resp)
+			resp.Body.Close()
+			cancelAttempt()
+			var ok bool
+			wait, ok = retryAfter(resp)
+			switch {
+			case resp.StatusCode == http.StatusTooManyRequests:
+				// 限流时换token只会把请求压到更多token上：有 Retry-After 时用同一个token等待后重试，否则直接返回
+				if !ok {
+					return nil, fail
+				}
+				keepToken = true
+			case !retryableStatus(resp.StatusCode):
+				return nil, fail
 			}
-			debugLog("上游错误: code=%d, detail=%s", errObj.Code, errObj.Detail)
-			// 结束下游流
-			endChunk := OpenAIResponse{
-				ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   config.DefaultModelName,
-				Choices: []Choice{{Index: 0, Delta: Delta{}, FinishReason: "stop"}},
+			if ok && wait > config().UpstreamRetryMaxDelay {
+				logger(ctx).Warn("上游要求的重试等待超过上限，不再重试", "retry_after", wait, "max_delay", config().UpstreamRetryMaxDelay)
+				return nil, fail
 			}
-			writeSSEChunk(w, endChunk)
-			fmt.Fprintf(w, "data: [DONE]\n\n")
-			flusher.Flush()
-			break
+			reason = fmt.Sprintf("status_%d", resp.StatusCode)
+		default:
+			// 响应体仍在 attemptCtx 下读取，关闭响应体时再释放
+			resp.Body = &cancelOnClose{resp.Body, cancelAttempt}
+			return resp, nil
 		}
 
-		debugLog("解析成功 - 类型: %s, 阶段: %s, 内容长度: %d, 完成: %v",
-			upstreamData.Type, upstreamData.Data.Phase, len(upstreamData.Data.DeltaContent), upstreamData.Data.Done)
-
-		// 策略2：总是展示thinking + answer
-		// 处理EditContent在最初的answer信息（只发送一次）
-		if !sentInitialAnswer && upstreamData.Data.EditContent != "" && upstreamData.Data.Phase == "answer" {
-			var out = upstreamData.Data.EditContent
-			if out != "" {
-				var parts = regexp.MustCompile(`\</details\>`).Split(out, -1)
-				if len(parts) > 1 {
-					var content = parts[1]
-					if content != "" {
-						debugLog("发送普通内容: %s", content)
-						chunk := OpenAIResponse{
-							ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
-							Object:  "chat.completion.chunk",
-							Created: time.Now().Unix(),
-							Model:   config.DefaultModelName,
-							Choices: []Choice{{Index: 0, Delta: Delta{Content: content}}},
-						}
-						writeSSEChunk(w, chunk)
-						flusher.Flush()
-						sentInitialAnswer = true
-					}
-				}
+		if attempt >= config().UpstreamRetries {
+			return nil, fail
+		}
+		delay := max(retryDelay(attempt), wait)
+		if keepToken {
+			delay = wait
+		}
+		logger(ctx).Info("上游请求失败，稍后重试", "reason", reason, "delay", delay, "retry", attempt+1)
+		upstreamRetries.Inc(reason)
+		if !sleepContext(ctx, delay) {
+			return nil, upstreamCallFailure(ctx, chatID, ctx.Err())
+		}
+		if !keepToken && len(upstreamReq.Files) == 0 {
+			upstreamPool.Release(*authToken)
+			if *authToken, fail = selectAuthToken(ctx); fail != nil {
+				return nil, fail
 			}
 		}
+	}
+}
+
+// upstreamCallFailure 上游请求没有拿到响应时的失败：超时、客户端取消或连接失败
+func upstreamCallFailure(ctx context.Context, chatID string, err error) *upstreamFailure {
+	if t := upstreamTimeoutError(ctx, err); t != nil {
+		logger(ctx).Warn("上游超时", "chat_id", chatID, "code", t.Code)
+		return &upstreamFailure{outcomeUpstreamTimeout, http.StatusGatewayTimeout, "timeout_error", t.Code, t.Message}
+	}
+	if ctx.Err() != nil {
+		logger(ctx).Info("客户端已取消请求", "chat_id", chatID)
+		return &upstreamFailure{Outcome: outcomeClientCancelled}
+	}
+	logger(ctx).Warn("调用上游失败", "chat_id", chatID, "error", err)
+	return &upstreamFailure{outcomeUpstreamError, http.StatusBadGateway, "api_error", "upstream_unreachable", "Failed to call upstream"}
+}
+
+// upstreamStatusFailure 将上游的非200响应转换为下游错误，带上上游返回的错误详情
+func upstreamStatusFailure(resp *http.Response) *upstreamFailure {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	logger(resp.Request.Context()).Warn("上游返回错误状态", "status", resp.StatusCode, "body", string(body))
 
-		if upstreamData.Data.DeltaContent != "" {
-			var out = upstreamData.Data.DeltaContent
-			if upstreamData.Data.Phase == "thinking" {
-				out = transformThinking(out)
-				// 思考内容使用 reasoning_content 字段
-				if out != "" {
-					debugLog("发送思考内容: %s", out)
-					chunk := OpenAIResponse{
-						ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
-						Object:  "chat.completion.chunk",
-						Created: time.Now().Unix(),
-						Model:   config.DefaultModelName,
-						Choices: []Choice{
-							{
-								Index: 0,
-								Delta: Delta{ReasoningContent: out},
-							},
-						},
-					}
-					writeSSEChunk(w, chunk)
-					flusher.Flush()
+	message := fmt.Sprintf("Upstream returned status %d", resp.StatusCode)
+	if detail := upstreamErrorDetail(body); detail != "" {
+		message += ": " + detail
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return &upstreamFailure{outcomeUpstreamError, http.StatusTooManyRequests, "rate_limit_error", "upstream_rate_limited", message}
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return &upstreamFailure{outcomeUpstreamError, http.StatusBadRequest, "invalid_request_error", "upstream_rejected_request", message}
+	default:
+		// 上游鉴权失败与5xx都是代理侧问题，统一返回502
+		return &upstreamFailure{outcomeUpstreamError, http.StatusBadGateway, "api_error", "upstream_error", message}
+	}
+}
+
+// upstreamErrorDetail 从上游错误响应体中取出错误说明
+func upstreamErrorDetail(body []byte) string {
+	var parsed struct {
+		Detail  interface{} `json:"detail"`
+		Message string      `json:"message"`
+		Error   interface{} `json:"error"`
+	}
+	if json.Unmarshal(body, &parsed) == nil {
+		for _, v := range []interface{}{parsed.Detail, parsed.Message, parsed.Error} {
+			switch v := v.(type) {
+			case string:
+				if v != "" {
+					return v
 				}
-			} else {
-				// 普通内容使用 content 字段
-				if out != "" {
-					debugLog("发送普通内容: %s", out)
-					chunk := OpenAIResponse{
-						ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
-						Object:  "chat.completion.chunk",
-						Created: time.Now().Unix(),
-						Model:   config.DefaultModelName,
-						Choices: []Choice{
-							{
-								Index: 0,
-								Delta: Delta{Content: out},
-							},
-						},
-					}
-					writeSSEChunk(w, chunk)
-					flusher.Flush()
+			case map[string]interface{}:
+				if msg, ok := v["message"].(string); ok && msg != "" {
+					return msg
+				}
+				if msg, ok := v["detail"].(string); ok && msg != "" {
+					return msg
 				}
 			}
 		}
-
-		// 检查是否结束
-		if upstreamData.Data.Done || upstreamData.Data.Phase == "done" {
-			debugLog("检测到流结束信号")
-			// 发送结束chunk
-			endChunk := OpenAIResponse{
-				ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   config.DefaultModelName,
-				Choices: []Choice{
-					{
-						Index:        0,
-						Delta:        Delta{},
-						FinishReason: "stop",
-					},
-				},
-			}
-			writeSSEChunk(w, endChunk)
-			flusher.Flush()
-
-			// 发送[DONE]
-			fmt.Fprintf(w, "data: [DONE]\n\n")
-			flusher.Flush()
-			debugLog("流式响应完成，共处理%d行", lineCount)
-			break
-		}
+		return ""
 	}
-
-	if err := scanner.Err(); err != nil {
-		debugLog("扫描器错误: %v", err)
+	// 非JSON响应（如网关的HTML错误页）不透传
+	text := strings.TrimSpace(string(body))
+	if text == "" || strings.HasPrefix(text, "<") {
+		return ""
 	}
+	if len(text) > 200 {
+		text = text[:200]
+	}
+	return text
 }
 
-func writeSSEChunk(w http.ResponseWriter, chunk OpenAIResponse) {
-	data, _ := json.Marshal(chunk)
-	fmt.Fprintf(w, "data: %s\n\n", data)
+// upstreamFrameFailure SSE流中的上游错误帧；错误码带上上游的数字错误码，如 upstream_500
+func upstreamFrameFailure(e *UpstreamError) *upstreamFailure {
+	code := "upstream_error"
+	if e.Code != 0 {
+		code = fmt.Sprintf("upstream_%d", e.Code)
+	}
+	return &upstreamFailure{outcomeUpstreamError, http.StatusBadGateway, "api_error", code,
+		fmt.Sprintf("Upstream error (code %d): %s", e.Code, e.Detail)}
 }
 
-func handleNonStreamResponseWithIDs(w http.ResponseWriter, upstreamReq UpstreamRequest, chatID string, authToken string) {
-	debugLog("开始处理非流式响应 (chat_id=%s)", chatID)
+// errStreamInterrupted 上游流没有结束帧就断开
+var errStreamInterrupted = &upstreamFailure{outcomeUpstreamError, http.StatusBadGateway, "api_error", "upstream_stream_interrupted", "Upstream stream ended unexpectedly"}
 
-	resp, err := callUpstreamWithHeaders(upstreamReq, chatID, authToken)
-	if err != nil {
-		debugLog("调用上游失败: %v", err)
-		http.Error(w, "Failed to call upstream", http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
+// collectUpstream 调用上游并把完整的SSE流交给组装器，不写下游响应
+func collectUpstream(ctx context.Context, upstreamReq UpstreamRequest, sess *chatSession) (asm *responseAssembler, fail *upstreamFailure) {
+	parent := ctx
+	ctx, cancel := limitUpstreamTotal(ctx)
+	defer cancel()
+	ctx, wd := watchUpstream(ctx)
+	defer wd.Stop()
 
-	if resp.StatusCode != http.StatusOK {
-		debugLog("上游返回错误状态: %d", resp.StatusCode)
-		// 读取错误响应体
-		if config.DebugMode {
-			body, _ := io.ReadAll(resp.Body)
-			debugLog("上游错误响应: %s", string(body))
-		}
-		http.Error(w, "Upstream error", http.StatusBadGateway)
-		return
+	resp, fail := openUpstream(ctx, upstreamReq, sess.ChatID, &sess.AuthToken)
+	if fail != nil {
+		return nil, fail
 	}
+	wd.Start()
+	defer resp.Body.Close()
+	st := startStreamTrace(ctx)
+	defer func() { st.End(fail) }()
 
-	// 收集完整响应（策略2：thinking与answer都纳入，thinking转换）
-	var fullContent strings.Builder
+	// 收集完整响应，与流式路径使用同一个组装器
+	asm = sess.newAssembler(upstreamReq.Messages)
 	scanner := bufio.NewScanner(resp.Body)
-	debugLog("开始收集完整响应内容")
+	reqLog := logger(ctx).With("chat_id", sess.ChatID)
+	reqLog.Debug("开始收集完整响应内容")
 
+	var finished bool
 	for scanner.Scan() {
 		line := scanner.Text()
 		if !strings.HasPrefix(line, "data: ") {
@@ -712,72 +1015,60 @@ func handleNonStreamResponseWithIDs(w http.ResponseWriter, upstreamReq UpstreamR
 			continue
 		}
 
+		wd.Event()
+
 		var upstreamData UpstreamData
 		if err := json.Unmarshal([]byte(dataStr), &upstreamData); err != nil {
 			continue
 		}
-
-		if upstreamData.Data.DeltaContent != "" {
-			out := upstreamData.Data.DeltaContent
-			if upstreamData.Data.Phase == "thinking" {
-				out = func(s string) string {
-					// 同步一份转换逻辑（与流式一致）
-					s = regexp.MustCompile(`(?s)<summary>.*?</summary>`).ReplaceAllString(s, "")
-					s = strings.ReplaceAll(s, "</thinking>", "")
-					s = strings.ReplaceAll(s, "<Full>", "")
-					s = strings.ReplaceAll(s, "</Full>", "")
-					s = strings.TrimSpace(s)
-					switch config.ThinkTagsMode {
-					case "think":
-						s = regexp.MustCompile(`<details[^>]*>`).ReplaceAllString(s, "<think>")
-						s = strings.ReplaceAll(s, "</details>", "</think>")
-					case "strip":
-						s = regexp.MustCompile(`<details[^>]*>`).ReplaceAllString(s, "")
-						s = strings.ReplaceAll(s, "</details>", "")
-					}
-					s = strings.TrimPrefix(s, "> ")
-					s = strings.ReplaceAll(s, "\n> ", "\n")
-					return strings.TrimSpace(s)
-				}(out)
-			}
-			if out != "" {
-				fullContent.WriteString(out)
-			}
+		st.Frame(upstreamData.Data.Phase)
+		if upstreamErr := upstreamData.upstreamError(); upstreamErr != nil {
+			reqLog.Warn("上游错误", "code", upstreamErr.Code, "detail", upstreamErr.Detail)
+			return nil, upstreamFrameFailure(upstreamErr)
 		}
 
-		if upstreamData.Data.Done || upstreamData.Data.Phase == "done" {
-			debugLog("检测到完成信号，停止收集")
+		if _, done := asm.Feed(&upstreamData); done {
+			reqLog.Debug("检测到完成信号，停止收集")
+			finished = true
 			break
 		}
 	}
+	asm.Finish()
 
-	finalContent := fullContent.String()
-	debugLog("内容收集完成，最终长度: %d", len(finalContent))
+	if parent.Err() != nil {
+		reqLog.Info("客户端已取消请求，停止收集")
+		return nil, &upstreamFailure{Outcome: outcomeClientCancelled}
+	}
+	if !finished {
+		// 没有结束帧时内容不完整，不能当作成功的回答返回
+		if t := upstreamTimeoutError(ctx, scanner.Err()); t != nil {
+			reqLog.Warn("上游超时", "code", t.Code)
+			return nil, &upstreamFailure{outcomeUpstreamTimeout, http.StatusGatewayTimeout, "timeout_error", t.Code, t.Message}
+		}
+		reqLog.Warn("上游流意外结束", "error", scanner.Err())
+		return nil, errStreamInterrupted
+	}
+	reqLog.Debug("内容收集完成", "length", len(asm.Content()))
+	return asm, nil
+}
 
-	// 构造完整响应
+// writeCompletion 写入非流式 chat.completion 响应
+func writeCompletion(w http.ResponseWriter, sess *chatSession, message Message, finishReason string, usage Usage) {
 	response := OpenAIResponse{
 		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
 		Object:  "chat.completion",
 		Created: time.Now().Unix(),
-		Model:   config.DefaultModelName,
+		Model:   sess.Model,
 		Choices: []Choice{
 			{
-				Index: 0,
-				Message: Message{
-					Role:    "assistant",
-					Content: finalContent,
-				},
-				FinishReason: "stop",
+				Index:        0,
+				Message:      message,
+				FinishReason: finishReason,
 			},
 		},
-		Usage: Usage{
-			PromptTokens:     0,
-			CompletionTokens: 0,
-			TotalTokens:      0,
-		},
+		Usage: &usage,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
-	debugLog("非流式响应发送完成")
-}
\ No newline at end of file
+}
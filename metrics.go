@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 延迟类直方图的桶（秒）
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300}
+
+// 匿名token获取耗时的桶（秒）
+var fetchBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	metricRequests = newCounterVec("z2api_requests_total",
+		"Chat requests by model, HTTP status and API key.", "model", "status", "key")
+	metricTTFT = newHistogramVec("z2api_time_to_first_token_seconds",
+		"Time from receiving a request to the first reasoning or answer token.", latencyBuckets, "model")
+	metricLatency = newHistogramVec("z2api_request_duration_seconds",
+		"Total time to serve a chat request.", latencyBuckets, "model")
+	metricUpstreamResponses = newCounterVec("z2api_upstream_responses_total",
+		"Upstream chat responses by HTTP status code (\"error\" when no response was received).", "status")
+	metricAnonFetches = newCounterVec("z2api_anon_token_fetches_total",
+		"Anonymous token fetches by result.", "result")
+	metricAnonFetchLatency = newHistogramVec("z2api_anon_token_fetch_duration_seconds",
+		"Time to fetch an anonymous token.", fetchBuckets)
+	metricTokens = newCounterVec("z2api_tokens_total",
+		"Tokens served by model and kind (prompt, reasoning or answer).", "model", "kind")
+	metricActiveStreams atomic.Int64
+)
+
+// counterVec 按标签区分的计数器
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64 // 键为以 \xff 拼接的标签值
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+// Add 累加计数，values 与标签一一对应
+func (c *counterVec) Add(n float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(values, "\xff")] += n
+}
+
+// Inc 计数加一
+func (c *counterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+// histogram 单个标签组合的直方图数据
+type histogram struct {
+	counts []uint64 // 与桶一一对应，非累计
+	sum    float64
+	count  uint64
+}
+
+// histogramVec 按标签区分的直方图
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	series     map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+// Observe 记录一个观测值
+func (h *histogramVec) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(values, "\xff")
+	s := h.series[key]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// ObserveSince 记录从 start 到现在经过的秒数
+func (h *histogramVec) ObserveSince(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatFloat(b)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), s.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels 生成 {a="x",b="y"}，extraName 非空时追加一个标签（直方图的 le）
+func formatLabels(names []string, key string, extraName, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			if i < len(names) {
+				pairs = append(pairs, names[i]+"="+strconv.Quote(v))
+			}
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+strconv.Quote(extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeGauge 输出一个无标签的 gauge
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+// writeTokenPoolMetrics 输出令牌池中每个token的健康状态与并发数；
+// /metrics 不鉴权，只以池中序号区分，不输出token的任何部分（对应关系见 /admin/tokens）
+func writeTokenPoolMetrics(w io.Writer) {
+	tokens := upstreamPool.Snapshot()
+	fmt.Fprintf(w, "# HELP z2api_token_pool_healthy Whether a pooled upstream token is usable (1) or cooling down (0).\n# TYPE z2api_token_pool_healthy gauge\n")
+	for i, t := range tokens {
+		healthy := 0
+		if t.Healthy {
+			healthy = 1
+		}
+		fmt.Fprintf(w, "z2api_token_pool_healthy{index=\"%d\"} %d\n", i, healthy)
+	}
+	fmt.Fprintf(w, "# HELP z2api_token_pool_in_flight Requests currently using a pooled upstream token.\n# TYPE z2api_token_pool_in_flight gauge\n")
+	for i, t := range tokens {
+		fmt.Fprintf(w, "z2api_token_pool_in_flight{index=\"%d\"} %d\n", i, t.InFlight)
+	}
+	fmt.Fprintf(w, "# HELP z2api_token_pool_failures Consecutive auth or rate-limit failures of a pooled upstream token.\n# TYPE z2api_token_pool_failures gauge\n")
+	for i, t := range tokens {
+		fmt.Fprintf(w, "z2api_token_pool_failures{index=\"%d\"} %d\n", i, t.Failures)
+	}
+}
+
+// handleMetrics 以 Prometheus 文本格式输出指标
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metricRequests.write(w)
+	metricTTFT.write(w)
+	metricLatency.write(w)
+	metricUpstreamResponses.write(w)
+	metricAnonFetches.write(w)
+	metricAnonFetchLatency.write(w)
+	metricTokens.write(w)
+	writeGauge(w, "z2api_active_streams", "Streaming responses currently being served.", float64(metricActiveStreams.Load()))
+	writeTokenPoolMetrics(w)
+}
+
+// requestMetrics 记录单个chat请求的状态码与耗时，请求结束时输出访问日志
+type requestMetrics struct {
+	http.ResponseWriter
+	r        *http.Request
+	start    time.Time
+	status   int
+	sawToken bool
+	Model    string // 实际使用的模型ID
+	Key      string // API key 名称
+}
+
+// trackRequest 包装 ResponseWriter 以记录状态码，请求结束时调用 Done
+func trackRequest(w http.ResponseWriter, r *http.Request) *requestMetrics {
+	return &requestMetrics{ResponseWriter: w, r: r, start: time.Now()}
+}
+
+func (m *requestMetrics) WriteHeader(status int) {
+	if m.status == 0 {
+		m.status = status
+	}
+	m.ResponseWriter.WriteHeader(status)
+}
+
+func (m *requestMetrics) Write(b []byte) (int, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
+	}
+	return m.ResponseWriter.Write(b)
+}
+
+func (m *requestMetrics) Flush() {
+	if f, ok := m.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap 供 http.ResponseController 使用
+func (m *requestMetrics) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+// FirstToken 首个token到达时调用，记录首token延迟；结构化输出重试时只记录第一次
+func (m *requestMetrics) FirstToken() {
+	if m.sawToken {
+		return
+	}
+	m.sawToken = true
+	metricTTFT.ObserveSince(m.start, m.Model)
+}
+
+// Done 记录请求计数与总耗时
+func (m *requestMetrics) Done() {
+	status := m.status
+	if status == 0 {
+		// 客户端在响应前断开
+		status = 499
+	}
+	metricRequests.Inc(m.Model, strconv.Itoa(status), m.Key)
+	span := trace.SpanFromContext(m.r.Context())
+	span.SetAttributes(
+		attribute.Int("http.response.status_code", status),
+		attribute.String("model", m.Model),
+		attribute.String("api_key.name", m.Key))
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	metricLatency.ObserveSince(m.start, m.Model)
+	logger(m.r.Context()).Info("请求完成",
+		"method", m.r.Method,
+		"path", m.r.URL.Path,
+		"status", status,
+		"model", m.Model,
+		"key", m.Key,
+		"duration_ms", time.Since(m.start).Milliseconds())
+}
+
+// recordTokenMetrics 按思考与回答分别记录用量
+func recordTokenMetrics(model string, usage Usage) {
+	if usage.TotalTokens == 0 {
+		return
+	}
+	reasoning := 0
+	if usage.CompletionTokensDetails != nil {
+		reasoning = usage.CompletionTokensDetails.ReasoningTokens
+	}
+	metricTokens.Add(float64(usage.PromptTokens), model, "prompt")
+	metricTokens.Add(float64(reasoning), model, "reasoning")
+	metricTokens.Add(float64(usage.CompletionTokens-reasoning), model, "answer")
+}
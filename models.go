@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ModelConfig 模型注册表中的单个模型
+type ModelConfig struct {
+	ID            string                 `json:"id" yaml:"id"`                                               // 对外暴露的模型ID
+	Aliases       []string               `json:"aliases,omitempty" yaml:"aliases,omitempty"`                 // 别名，如 gpt-4o
+	UpstreamID    string                 `json:"upstream_id" yaml:"upstream_id"`                             // 上游实际模型ID
+	Name          string                 `json:"name,omitempty" yaml:"name,omitempty"`                       // 上游 model_item.name
+	OwnedBy       string                 `json:"owned_by,omitempty" yaml:"owned_by,omitempty"`               // /v1/models 中的 owned_by
+	Features      map[string]interface{} `json:"features,omitempty" yaml:"features,omitempty"`               // 上游 features，如 enable_thinking、web_search
+	MCPServers    []string               `json:"mcp_servers,omitempty" yaml:"mcp_servers,omitempty"`         // 上游 MCP 服务，如 deep-web-search
+	ThinkTagsMode string                 `json:"think_tags_mode,omitempty" yaml:"think_tags_mode,omitempty"` // 该模型默认的思考标签处理策略
+	Vision        bool                   `json:"vision,omitempty" yaml:"vision,omitempty"`                   // 是否支持图片输入
+}
+
+// modelRegistry 模型注册表
+type modelRegistry struct {
+	mu     sync.RWMutex
+	models []*ModelConfig
+	byName map[string]*ModelConfig // 小写的ID与别名
+}
+
+// 全局模型注册表
+var models *modelRegistry
+
+// 默认上游模型
+const defaultUpstreamModelID = "0727-360B-API"
+
+// newModelRegistry 按配置创建模型注册表
+func newModelRegistry(c *Config) (*modelRegistry, error) {
+	list, byName, err := loadModels(c)
+	if err != nil {
+		return nil, err
+	}
+	r := &modelRegistry{}
+	r.set(list, byName)
+	return r, nil
+}
+
+// builtinModels 兼容旧配置的三个内置模型
+func builtinModels(c *Config) []*ModelConfig {
+	return []*ModelConfig{
+		{
+			ID:         c.DefaultModelName,
+			UpstreamID: defaultUpstreamModelID,
+			Name:       "GLM-4.5",
+		},
+		{
+			ID:         c.ThinkingModelName,
+			UpstreamID: defaultUpstreamModelID,
+			Name:       "GLM-4.5",
+			Features:   map[string]interface{}{"enable_thinking": true},
+		},
+		{
+			ID:         c.SearchModelName,
+			UpstreamID: defaultUpstreamModelID,
+			Name:       "GLM-4.5",
+			Features: map[string]interface{}{
+				"enable_thinking": true,
+				"web_search":      true,
+				"auto_web_search": true,
+			},
+			MCPServers: []string{"deep-web-search"},
+		},
+	}
+}
+
+// loadModels 读取模型列表：配置文件中的 models、MODELS_FILE，都未设置时使用
+// DEFAULT/THINKING/SEARCH_MODEL_NAME 三个内置模型
+func loadModels(c *Config) ([]*ModelConfig, map[string]*ModelConfig, error) {
+	list := builtinModels(c)
+	source := "models"
+	if len(c.Models) > 0 {
+		list = c.Models
+	}
+	if c.ModelsFile != "" {
+		data, err := os.ReadFile(c.ModelsFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		var file struct {
+			Models []*ModelConfig `json:"models" yaml:"models"`
+		}
+		switch strings.ToLower(filepath.Ext(c.ModelsFile)) {
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(data, &file)
+		default:
+			err = json.Unmarshal(data, &file)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse %s: %v", c.ModelsFile, err)
+		}
+		if len(file.Models) == 0 {
+			return nil, nil, fmt.Errorf("%s: no models defined", c.ModelsFile)
+		}
+		list = file.Models
+		source = c.ModelsFile
+	}
+
+	byName := map[string]*ModelConfig{}
+	for i, m := range list {
+		if m.ID == "" {
+			return nil, nil, fmt.Errorf("%s: models[%d]: id is required", source, i)
+		}
+		if m.ThinkTagsMode != "" && !validThinkTagsMode(m.ThinkTagsMode) {
+			return nil, nil, fmt.Errorf("%s: models[%d]: think_tags_mode must be one of strip, think, raw, got %q", source, i, m.ThinkTagsMode)
+		}
+		if m.UpstreamID == "" {
+			m.UpstreamID = defaultUpstreamModelID
+		}
+		if m.Name == "" {
+			m.Name = m.ID
+		}
+		if m.OwnedBy == "" {
+			m.OwnedBy = "z.ai"
+		}
+		for _, name := range append([]string{m.ID}, m.Aliases...) {
+			key := strings.ToLower(name)
+			if byName[key] != nil {
+				return nil, nil, fmt.Errorf("%s: models[%d]: duplicate model name %q", source, i, name)
+			}
+			byName[key] = m
+		}
+	}
+	return list, byName, nil
+}
+
+// set 替换模型列表
+func (r *modelRegistry) set(list []*ModelConfig, byName map[string]*ModelConfig) {
+	r.mu.Lock()
+	r.models = list
+	r.byName = byName
+	r.mu.Unlock()
+	debugLog("已加载%d个模型", len(list))
+}
+
+// Resolve 按ID或别名查找模型，未找到时返回默认（第一个）模型与 false
+func (r *modelRegistry) Resolve(name string) (*ModelConfig, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if m := r.byName[strings.ToLower(name)]; m != nil {
+		return m, true
+	}
+	return r.models[0], false
+}
+
+// List 返回所有模型
+func (r *modelRegistry) List() []*ModelConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*ModelConfig(nil), r.models...)
+}
+
+// Default 默认模型
+func (r *modelRegistry) Default() *ModelConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.models[0]
+}
+
+// allowedBy key是否可以使用该模型（ID或任一别名在白名单中即可）
+func (m *ModelConfig) allowedBy(key *APIKey) bool {
+	if key.AllowsModel(m.ID) {
+		return true
+	}
+	for _, alias := range m.Aliases {
+		if key.AllowsModel(alias) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamFeatures 生成上游 features，未配置的开关默认关闭
+func (m *ModelConfig) upstreamFeatures() map[string]interface{} {
+	features := map[string]interface{}{
+		"enable_thinking": false,
+		"web_search":      false,
+		"auto_web_search": false,
+	}
+	for k, v := range m.Features {
+		features[k] = v
+	}
+	return features
+}
+
+func handleModels(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	key := authenticateRequest(w, r)
+	if key == nil {
+		return
+	}
+
+	// 只列出当前key可以使用的模型
+	data := []Model{}
+	for _, m := range models.List() {
+		if !m.allowedBy(key) {
+			continue
+		}
+		data = append(data, Model{
+			ID:      m.ID,
+			Object:  "model",
+			Created: time.Now().Unix(),
+			OwnedBy: m.OwnedBy,
+		})
+	}
+	response := ModelsResponse{
+		Object: "list",
+		Data:   data,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
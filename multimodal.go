@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// ContentPart OpenAI 多模态消息中的内容片段
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+// ImageURL 图片片段，URL 可以是 data URL 或 http(s) 地址
+type ImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// UpstreamFile 上游请求 files 中引用的已上传文件
+type UpstreamFile struct {
+	Type   string          `json:"type"`
+	File   json.RawMessage `json:"file"` // 上游上传接口的原始响应
+	ID     string          `json:"id"`
+	URL    string          `json:"url"`
+	Name   string          `json:"name"`
+	Status string          `json:"status"`
+	Size   int             `json:"size"`
+	Error  string          `json:"error"`
+	Media  string          `json:"media"`
+}
+
+// UnmarshalJSON content 既可以是字符串，也可以是内容片段数组；
+// 数组中的文本片段拼接到 Content，完整片段保存在 Parts 中
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type plain Message
+	raw := struct {
+		*plain
+		Content json.RawMessage `json:"content"`
+	}{plain: (*plain)(m)}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	m.Content = ""
+	m.Parts = nil
+	content := bytes.TrimSpace(raw.Content)
+	if len(content) == 0 || bytes.Equal(content, []byte("null")) {
+		return nil
+	}
+	if content[0] == '"' {
+		return json.Unmarshal(content, &m.Content)
+	}
+	if err := json.Unmarshal(content, &m.Parts); err != nil {
+		return fmt.Errorf("content must be a string or an array of content parts: %v", err)
+	}
+	var texts []string
+	for i, p := range m.Parts {
+		switch p.Type {
+		case "text":
+			texts = append(texts, p.Text)
+		case "image_url":
+			if p.ImageURL == nil || p.ImageURL.URL == "" {
+				return fmt.Errorf("content[%d]: image_url.url is required", i)
+			}
+		default:
+			return fmt.Errorf("content[%d]: unsupported content part type %q", i, p.Type)
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
+}
+
+// MarshalJSON 带图片的消息以内容片段数组发送给上游，其余情况 content 为字符串
+func (m Message) MarshalJSON() ([]byte, error) {
+	type plain Message
+	if !m.HasImages() {
+		return json.Marshal(plain(m))
+	}
+	return json.Marshal(struct {
+		plain
+		Content []ContentPart `json:"content"`
+	}{plain(m), m.Parts})
+}
+
+// HasImages 消息是否包含图片片段
+func (m *Message) HasImages() bool {
+	for _, p := range m.Parts {
+		if p.Type == "image_url" {
+			return true
+		}
+	}
+	return false
+}
+
+// messagesHaveImages 消息列表中是否有图片
+func messagesHaveImages(messages []Message) bool {
+	for i := range messages {
+		if messages[i].HasImages() {
+			return true
+		}
+	}
+	return false
+}
+
+// imageError 图片读取或上传失败
+type imageError struct {
+	Status  int
+	Type    string
+	Code    string
+	Message string
+}
+
+func (e *imageError) Error() string {
+	return e.Message
+}
+
+// uploadMessageImages 将消息中的图片上传到上游文件接口，并把图片片段改为引用上传后的文件
+func uploadMessageImages(ctx context.Context, upstreamReq *UpstreamRequest, authToken string) *imageError {
+	client := &http.Client{Transport: upstreamTransport, Timeout: config().ImageFetchTimeout}
+	fetch := newImageFetchClient()
+	for i := range upstreamReq.Messages {
+		parts := upstreamReq.Messages[i].Parts
+		for j := range parts {
+			if parts[j].Type != "image_url" {
+				continue
+			}
+			data, contentType, err := loadImage(ctx, fetch, parts[j].ImageURL.URL)
+			if err != nil {
+				logger(ctx).Info("读取图片失败", "error", err)
+				return &imageError{http.StatusBadRequest, "invalid_request_error", "invalid_image", err.Error()}
+			}
+			file, err := uploadImage(ctx, client, authToken, data, contentType)
+			if err != nil {
+				logger(ctx).Warn("上传图片失败", "error", err)
+				return &imageError{http.StatusBadGateway, "api_error", "upstream_upload_failed", "Failed to upload image to upstream"}
+			}
+			logger(ctx).Debug("图片已上传", "file_id", file.ID, "size", file.Size)
+			parts[j].ImageURL = &ImageURL{URL: file.ID, Detail: parts[j].ImageURL.Detail}
+			upstreamReq.Files = append(upstreamReq.Files, file)
+		}
+	}
+	return nil
+}
+
+// loadImage 解码 data URL 或下载 http(s) 图片（需开启 IMAGE_URL_FETCH），大小受 IMAGE_MAX_BYTES 限制
+func loadImage(ctx context.Context, client *http.Client, rawURL string) ([]byte, string, error) {
+	if strings.HasPrefix(rawURL, "data:") {
+		meta, payload, ok := strings.Cut(strings.TrimPrefix(rawURL, "data:"), ",")
+		if !ok || !strings.HasSuffix(meta, ";base64") {
+			return nil, "", fmt.Errorf("image data URL must be base64 encoded")
+		}
+		if base64.StdEncoding.DecodedLen(len(payload)) > int(config().ImageMaxBytes)+2 {
+			return nil, "", fmt.Errorf("image exceeds the %d byte limit", config().ImageMaxBytes)
+		}
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid base64 image data: %v", err)
+		}
+		if int64(len(data)) > config().ImageMaxBytes {
+			return nil, "", fmt.Errorf("image exceeds the %d byte limit", config().ImageMaxBytes)
+		}
+		return data, strings.TrimSuffix(meta, ";base64"), nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, "", fmt.Errorf("image_url must be a data URL or an http(s) URL")
+	}
+	if !config().ImageURLFetch {
+		return nil, "", fmt.Errorf("image_url must be a base64 data URL; fetching http(s) image URLs is disabled on this server")
+	}
+	if err := checkImageURL(u); err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch image: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to fetch image: status %d", resp.StatusCode)
+	}
+	if resp.ContentLength > config().ImageMaxBytes {
+		return nil, "", fmt.Errorf("image exceeds the %d byte limit", config().ImageMaxBytes)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, config().ImageMaxBytes+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch image: %v", err)
+	}
+	if int64(len(data)) > config().ImageMaxBytes {
+		return nil, "", fmt.Errorf("image exceeds the %d byte limit", config().ImageMaxBytes)
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// newImageFetchClient 下载客户端提供的图片地址：不经过代理，也不复用上游连接池；
+// 拨号时检查解析出的IP，只连接公网地址，重定向的目标同样重新检查
+func newImageFetchClient() *http.Client {
+	dialer := &net.Dialer{Timeout: config().UpstreamConnectTimeout, Control: rejectNonPublicAddr}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: config().UpstreamConnectTimeout,
+			DisableKeepAlives:   true,
+		},
+		Timeout: config().ImageFetchTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("stopped after 3 redirects")
+			}
+			return checkImageURL(req.URL)
+		},
+	}
+}
+
+// checkImageURL 检查图片地址的协议，以及主机是否在 IMAGE_URL_ALLOWLIST 中
+func checkImageURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("image_url must be an http(s) URL")
+	}
+	allowlist := strings.TrimSpace(config().ImageURLAllowlist)
+	if allowlist == "" {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, entry := range strings.Split(allowlist, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if host == entry || (strings.HasPrefix(entry, ".") && strings.HasSuffix(host, entry)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("image_url host %q is not allowed", u.Hostname())
+}
+
+// cgnatRange 运营商级NAT地址（100.64.0.0/10），同样视为内网
+var cgnatRange = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// rejectNonPublicAddr 拒绝连接回环、内网、链路本地（含云平台元数据地址）、组播与未指定地址
+func rejectNonPublicAddr(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || cgnatRange.Contains(ip) {
+		return fmt.Errorf("image_url resolves to a non-public address %s", host)
+	}
+	return nil
+}
+
+// uploadImage 通过上游文件接口上传图片
+func uploadImage(ctx context.Context, client *http.Client, authToken string, data []byte, contentType string) (UpstreamFile, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !strings.HasPrefix(mediaType, "image/") {
+		mediaType = http.DetectContentType(data)
+	}
+	name := "image"
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		name += exts[0]
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		return UpstreamFile{}, err
+	}
+	fw.Write(data)
+	mw.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", upstreamAPIURL("/api/v1/files/"), &body)
+	if err != nil {
+		return UpstreamFile{}, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", BrowserUa)
+	req.Header.Set("Authorization", "Bearer "+authToken)
+	req.Header.Set("sec-ch-ua", SecChUa)
+	req.Header.Set("sec-ch-ua-mobile", SecChUaMob)
+	req.Header.Set("sec-ch-ua-platform", SecChUaPlat)
+	req.Header.Set("X-FE-Version", config().FEVersion)
+	req.Header.Set("Origin", OriginBase)
+	req.Header.Set("Referer", OriginBase+"/")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return UpstreamFile{}, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return UpstreamFile{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return UpstreamFile{}, fmt.Errorf("upload status=%d body=%s", resp.StatusCode, raw)
+	}
+	var uploaded struct {
+		ID       string `json:"id"`
+		Filename string `json:"filename"`
+	}
+	if err := json.Unmarshal(raw, &uploaded); err != nil {
+		return UpstreamFile{}, err
+	}
+	if uploaded.ID == "" {
+		return UpstreamFile{}, fmt.Errorf("upload response has no file id")
+	}
+	if uploaded.Filename == "" {
+		uploaded.Filename = name
+	}
+	return UpstreamFile{
+		Type:   "image",
+		File:   raw,
+		ID:     uploaded.ID,
+		URL:    "/api/v1/files/" + uploaded.ID + "/content",
+		Name:   uploaded.Filename,
+		Status: "uploaded",
+		Size:   len(data),
+		Media:  "image",
+	}, nil
+}
+
+// upstreamAPIURL 以 UPSTREAM_URL 的协议与主机拼接上游其他接口地址
+func upstreamAPIURL(path string) string {
+	u, err := url.Parse(config().UpstreamUrl)
+	if err != nil || u.Host == "" {
+		return OriginBase + path
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: path}).String()
+}
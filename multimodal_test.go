@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// withConfig 在默认配置上应用 set 作为当前配置，测试结束后恢复
+func withConfig(t *testing.T, set func(c *Config)) {
+	t.Helper()
+	prev := config()
+	c := defaultConfig()
+	set(c)
+	currentConfig.Store(c)
+	t.Cleanup(func() { currentConfig.Store(prev) })
+}
+
+func TestRejectNonPublicAddr(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"127.0.0.1:80", false},
+		{"127.1.2.3:80", false},
+		{"[::1]:443", false},
+		{"10.0.0.1:80", false},
+		{"172.16.5.4:80", false},
+		{"192.168.1.1:80", false},
+		{"100.64.0.1:80", false},
+		{"100.127.255.254:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"[fc00::1]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"[::ffff:169.254.169.254]:80", false},
+		{"[::ffff:10.1.2.3]:80", false},
+		{"0.0.0.0:80", false},
+		{"[::]:80", false},
+		{"224.0.0.1:80", false},
+		{"not-an-ip:80", false},
+		{"8.8.8.8:443", true},
+		{"100.63.255.255:80", true},
+		{"100.128.0.1:80", true},
+		{"[2606:4700:4700::1111]:443", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := rejectNonPublicAddr("tcp", tt.address, nil)
+			if (err == nil) != tt.allowed {
+				t.Errorf("got error %v, want allowed=%v", err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestCheckImageURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowlist string
+		url       string
+		allowed   bool
+	}{
+		{"no allowlist", "", "https://anything.test/a.png", true},
+		{"non-http scheme", "", "file:///etc/passwd", false},
+		{"exact host", "example.com", "https://example.com/a.png", true},
+		{"exact host case-insensitive", "Example.COM", "https://EXAMPLE.com/a.png", true},
+		{"exact entry does not match subdomain", "example.com", "https://cdn.example.com/a.png", false},
+		{"subdomain entry", ".example.com", "https://cdn.example.com/a.png", true},
+		{"nested subdomain", ".example.com", "https://a.b.example.com/a.png", true},
+		{"suffix confusion", ".example.com", "https://evilexample.com/a.png", false},
+		{"suffix confusion exact", "example.com", "https://evilexample.com/a.png", false},
+		{"suffix as subdomain of attacker", ".example.com", "https://example.com.evil.test/a.png", false},
+		{"port ignored", "example.com", "https://example.com:8443/a.png", true},
+		{"userinfo ignored", "example.com", "https://example.com@evil.test/a.png", false},
+		{"multiple entries", "a.test, .example.com", "https://img.example.com/a.png", true},
+		{"not listed", "a.test,.example.com", "https://b.test/a.png", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ImageURLAllowlist = tt.allowlist })
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkImageURL(u); (err == nil) != tt.allowed {
+				t.Errorf("got error %v, want allowed=%v", err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestLoadImageDataURL(t *testing.T) {
+	dataURL := func(n int) string {
+		return "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", n)))
+	}
+	tests := []struct {
+		name    string
+		url     string
+		wantErr string // 为空表示应通过
+	}{
+		{"at limit", dataURL(16), ""},
+		{"one byte over", dataURL(17), "exceeds the 16 byte limit"},
+		{"far over", dataURL(1 << 20), "exceeds the 16 byte limit"},
+		{"not base64 encoded", "data:image/png,abc", "must be base64 encoded"},
+		{"invalid base64", "data:image/png;base64,!!!!", "invalid base64"},
+		{"unsupported scheme", "ftp://example.com/a.png", "must be a data URL or an http(s) URL"},
+		{"fetching disabled", "https://example.com/a.png", "fetching http(s) image URLs is disabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ImageMaxBytes = 16 })
+			data, contentType, err := loadImage(context.Background(), http.DefaultClient, tt.url)
+			if tt.wantErr == "" {
+				if err != nil || len(data) != 16 || contentType != "image/png" {
+					t.Fatalf("got %d bytes, %q, %v", len(data), contentType, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadImageFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "http://metadata.internal/latest", http.StatusFound)
+		case "/big":
+			w.Write([]byte(strings.Repeat("x", 17)))
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png"))
+		}
+	}))
+	defer srv.Close()
+
+	// 使用真实的下载客户端，但改用不检查地址的拨号，以便连接本机的测试服务器
+	testClient := func() *http.Client {
+		client := newImageFetchClient()
+		client.Transport = http.DefaultTransport
+		return client
+	}
+	tests := []struct {
+		name    string
+		client  func() *http.Client
+		path    string
+		wantErr string // 为空表示应通过
+	}{
+		{"allowed host", testClient, "/a.png", ""},
+		{"redirect target re-checked", testClient, "/redirect", `image_url host "metadata.internal" is not allowed`},
+		{"body over limit", testClient, "/big", "exceeds the 16 byte limit"},
+		{"loopback refused at dial", newImageFetchClient, "/a.png", "non-public address 127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.ImageURLFetch = true
+				c.ImageURLAllowlist = "127.0.0.1"
+				c.ImageMaxBytes = 16
+			})
+			data, contentType, err := loadImage(context.Background(), tt.client(), srv.URL+tt.path)
+			if tt.wantErr == "" {
+				if err != nil || string(data) != "png" || contentType != "image/png" {
+					t.Fatalf("got %q, %q, %v", data, contentType, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
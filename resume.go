@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// continuationPrompt 续写请求中追加的用户指令
+const continuationPrompt = "Your previous reply was cut off. Continue it exactly from where it stopped. " +
+	"Do not repeat any text that was already written and do not add any preamble."
+
+// ResponseMetadata 代理附加在流式chunk上的元数据
+type ResponseMetadata struct {
+	Resumed     bool `json:"resumed"`      // 上游中途断开后已续写
+	ResumeCount int  `json:"resume_count"` // 续写次数
+}
+
+// continuationRequest 构造上游中断后的续写请求
+//
+// 已输出的回答作为 assistant 前缀，再追加一条要求从断点继续的指令，
+// 并关闭思考，避免续写重新输出思考过程。只在已经输出回答后续写（见 Resumable）
+func continuationRequest(req UpstreamRequest, partial string) UpstreamRequest {
+	next := req
+	next.ID = fmt.Sprintf("%d", time.Now().UnixNano())
+	next.Messages = append(append([]Message{}, req.Messages...),
+		Message{Role: "assistant", Content: partial},
+		Message{Role: "user", Content: continuationPrompt},
+	)
+	next.Features = make(map[string]interface{}, len(req.Features)+1)
+	for k, v := range req.Features {
+		next.Features[k] = v
+	}
+	next.Features["enable_thinking"] = false
+	return next
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 上游重试原因统计，键如 connect_error、status_429、anon_token
+var upstreamRetries = &outcomeCounter{counts: map[string]int64{}}
+
+// retryableStatus 可以换token重试的上游状态码：token失效与网关类错误；429 不换token，见 openUpstream
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusUnauthorized,
+		http.StatusForbidden,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryDelay 第 attempt 次重试（从0开始）前的等待时间：指数退避，取 [d/2, d] 之间的随机值
+func retryDelay(attempt int) time.Duration {
+	d := config().UpstreamRetryBaseDelay << attempt
+	if d <= 0 || d > config().UpstreamRetryMaxDelay {
+		d = config().UpstreamRetryMaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter 解析上游的 Retry-After 头（秒数或HTTP日期）
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// sleepContext 等待 d，context 结束时提前返回 false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upstreamReply 测试上游的一次响应
+type upstreamReply struct {
+	status     int
+	retryAfter string
+	frames     []string // 200 时依次写出的 data 帧
+}
+
+// fakeUpstream 按顺序返回预设响应的测试上游，记录每次请求使用的token
+type fakeUpstream struct {
+	mu      sync.Mutex
+	replies []upstreamReply
+	tokens  []string
+}
+
+func (u *fakeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	n := len(u.tokens)
+	u.tokens = append(u.tokens, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	reply := u.replies[min(n, len(u.replies)-1)]
+	u.mu.Unlock()
+
+	if reply.retryAfter != "" {
+		w.Header().Set("Retry-After", reply.retryAfter)
+	}
+	if reply.status != http.StatusOK {
+		w.WriteHeader(reply.status)
+		fmt.Fprintf(w, `{"detail":"status %d"}`, reply.status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, f := range reply.frames {
+		fmt.Fprintf(w, "data: %s\n\n", f)
+		w.(http.Flusher).Flush()
+	}
+}
+
+func (u *fakeUpstream) requests() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.tokens...)
+}
+
+// withFakeUpstream 启动测试上游，令牌池为 tok-a、tok-b，不使用匿名token
+func withFakeUpstream(t *testing.T, replies []upstreamReply, set func(c *Config)) *fakeUpstream {
+	t.Helper()
+	u := &fakeUpstream{replies: replies}
+	srv := httptest.NewServer(u)
+	t.Cleanup(srv.Close)
+	withConfig(t, func(c *Config) {
+		c.UpstreamUrl = srv.URL
+		c.AnonTokenEnabled = false
+		c.UpstreamTokens = "tok-a,tok-b"
+		c.UpstreamRetries = 2
+		c.UpstreamRetryBaseDelay = time.Millisecond
+		c.UpstreamRetryMaxDelay = 10 * time.Millisecond
+		c.UpstreamResumeAttempts = 0
+		if set != nil {
+			set(c)
+		}
+	})
+	prevClient, prevTransport, prevPool := upstreamClient, upstreamTransport, upstreamPool
+	t.Cleanup(func() { upstreamClient, upstreamTransport, upstreamPool = prevClient, prevTransport, prevPool })
+	initUpstreamClient()
+	specs, err := loadTokenSpecs(config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamPool = newTokenPool(specs, config().TokenPoolStrategy, config().TokenCooldownBase, config().TokenCooldownMax)
+	return u
+}
+
+const answerFrameJSON = `{"type":"chat:completion","data":{"phase":"answer","delta_content":"Hello"}}`
+
+func TestOpenUpstreamRetry(t *testing.T) {
+	ok := upstreamReply{status: http.StatusOK, frames: []string{`{"data":{"phase":"done","done":true}}`}}
+	tests := []struct {
+		name       string
+		replies    []upstreamReply
+		wantStatus int // 0 表示应成功
+		wantTokens []string
+	}{
+		{"success", []upstreamReply{ok}, 0, []string{"tok-a"}},
+		{"5xx retried with a new token", []upstreamReply{{status: 503}, {status: 502}, ok}, 0, []string{"tok-a", "tok-b", "tok-a"}},
+		{"5xx retries exhausted", []upstreamReply{{status: 500}}, http.StatusBadGateway, []string{"tok-a", "tok-b", "tok-a"}},
+		{"401 retried with a new token", []upstreamReply{{status: 401}, ok}, 0, []string{"tok-a", "tok-b"}},
+		{"429 without Retry-After not retried", []upstreamReply{{status: 429}, ok}, http.StatusTooManyRequests, []string{"tok-a"}},
+		{"429 with Retry-After retried on the same token", []upstreamReply{{status: 429, retryAfter: "0"}, ok}, 0, []string{"tok-a", "tok-a"}},
+		{"429 Retry-After above the maximum", []upstreamReply{{status: 429, retryAfter: "120"}, ok}, http.StatusTooManyRequests, []string{"tok-a"}},
+		{"5xx Retry-After above the maximum", []upstreamReply{{status: 503, retryAfter: "120"}, ok}, http.StatusBadGateway, []string{"tok-a"}},
+		{"4xx not retried", []upstreamReply{{status: 400}, ok}, http.StatusBadRequest, []string{"tok-a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := withFakeUpstream(t, tt.replies, nil)
+			token, _ := selectAuthToken(context.Background())
+			resp, fail := openUpstream(context.Background(), UpstreamRequest{}, "chat", &token)
+			if tt.wantStatus == 0 {
+				if fail != nil {
+					t.Fatalf("unexpected failure: %+v", fail)
+				}
+				resp.Body.Close()
+			} else if fail == nil {
+				resp.Body.Close()
+				t.Fatalf("want status %d, got success", tt.wantStatus)
+			} else if fail.Status != tt.wantStatus {
+				t.Errorf("status %d, want %d", fail.Status, tt.wantStatus)
+			}
+			if got := u.requests(); strings.Join(got, ",") != strings.Join(tt.wantTokens, ",") {
+				t.Errorf("upstream requests with tokens %v, want %v", got, tt.wantTokens)
+			}
+		})
+	}
+}
+
+// recordingSink 记录 streamUpstream 写给下游的内容
+type recordingSink struct {
+	content strings.Builder
+	closed  bool
+	failure *upstreamFailure
+}
+
+func (s *recordingSink) Open() bool               { return true }
+func (s *recordingSink) Delta(d assembledDelta)   { s.content.WriteString(d.Content) }
+func (s *recordingSink) Resumed(int)              {}
+func (s *recordingSink) Close(*responseAssembler) { s.closed = true }
+func (s *recordingSink) Fail(f *upstreamFailure)  { s.failure = f }
+func (s *recordingSink) Gone() bool               { return false }
+
+// 已向下游写出内容后上游失败，不再重发原请求，以错误事件结束
+func TestStreamUpstreamNoRetryAfterOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		frames   []string
+		wantCode string
+	}{
+		{"stream cut off", []string{answerFrameJSON}, errStreamInterrupted.Code},
+		{"error frame", []string{answerFrameJSON, `{"data":{"error":{"detail":"boom","code":500}}}`}, "upstream_500"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := withFakeUpstream(t, []upstreamReply{{status: http.StatusOK, frames: tt.frames}}, nil)
+			sess := &chatSession{ChatID: "chat", ThinkTagsMode: "strip", Log: discardLogger}
+			sess.AuthToken, _ = selectAuthToken(context.Background())
+			sink := &recordingSink{}
+			streamUpstream(context.Background(), UpstreamRequest{}, sess, sink)
+			if got := sink.content.String(); got != "Hello" {
+				t.Errorf("downstream content %q, want %q", got, "Hello")
+			}
+			if sink.closed || sink.failure == nil || sink.failure.Code != tt.wantCode {
+				t.Errorf("closed %v, failure %+v, want code %s", sink.closed, sink.failure, tt.wantCode)
+			}
+			if n := len(u.requests()); n != 1 {
+				t.Errorf("%d upstream requests, want 1", n)
+			}
+		})
+	}
+}
+
+func TestAwaitHeaders(t *testing.T) {
+	withConfig(t, func(c *Config) { c.UpstreamFirstByteTimeout = 20 * time.Millisecond })
+
+	ctx, stop, cancel := awaitHeaders(context.Background())
+	if !stop() {
+		t.Fatal("stop reported a timeout")
+	}
+	cancel()
+	if ctx.Err() == nil || errors.Is(context.Cause(ctx), errFirstEventTimeout) {
+		t.Errorf("cancel did not release the context, cause %v", context.Cause(ctx))
+	}
+
+	ctx, stop, cancel = awaitHeaders(context.Background())
+	defer cancel()
+	<-ctx.Done()
+	if stop() || !errors.Is(context.Cause(ctx), errFirstEventTimeout) {
+		t.Errorf("cause %v, want errFirstEventTimeout", context.Cause(ctx))
+	}
+}
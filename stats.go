@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// 请求结果分类
+const (
+	outcomeCompleted       = "completed"
+	outcomeClientCancelled = "client_cancelled"
+	outcomeUpstreamError   = "upstream_error"
+	outcomeUpstreamTimeout = "upstream_timeout"
+)
+
+// outcomeCounter 按结果统计请求次数
+type outcomeCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// 全局请求结果统计
+var requestOutcomes = &outcomeCounter{counts: map[string]int64{}}
+
+// Inc 记录一次请求结果
+func (c *outcomeCounter) Inc(outcome string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[outcome]++
+}
+
+// Snapshot 返回当前统计的副本
+func (c *outcomeCounter) Snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]int64, len(c.counts))
+	for k, v := range c.counts {
+		out[k] = v
+	}
+	return out
+}
+
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !checkAdminAuth(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"outcomes": requestOutcomes.Snapshot(),
+		"retries":  upstreamRetries.Snapshot(),
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// streamSink 流式响应的下游输出格式
+//
+// streamUpstream 负责读取上游、超时、续写与错误处理，sink 只负责把组装器的输出
+// 写成 OpenAI chunk 或 Anthropic 事件，两种接口的流式行为因此完全一致。
+type streamSink interface {
+	// Open 上游返回成功后写出SSE头部与开头的事件；返回 false 表示无法流式输出，错误响应已写出
+	Open() bool
+	// Delta 写出一段增量
+	Delta(d assembledDelta)
+	// Resumed 上游中断后已发送第 count 次续写请求
+	Resumed(count int)
+	// Close 上游正常结束，写出结束事件
+	Close(asm *responseAssembler)
+	// Fail 记录请求结果并以错误结束；Open 之前调用时返回带状态码的错误响应，之后以错误事件结束流
+	Fail(f *upstreamFailure)
+	// Gone 写入下游失败，客户端已断开
+	Gone() bool
+}
+
+// streamUpstream 流式读取上游并通过 sink 写给下游，返回本次用量
+//
+// 上游中途断开时换token发送续写请求，继续写入同一个下游响应；
+// 超时或上游错误以错误事件结束下游流，而不是静默截断
+func streamUpstream(ctx context.Context, upstreamReq UpstreamRequest, sess *chatSession, sink streamSink) Usage {
+	reqLog := sess.Log.With("chat_id", sess.ChatID)
+	reqLog.Debug("开始处理流式响应")
+
+	parent := ctx
+	streamCtx, cancel := limitUpstreamTotal(ctx)
+	defer cancel()
+	// 每次上游请求（含续写）使用独立的首事件与空闲超时监控，总时长上限共用
+	ctx, wd := watchUpstream(streamCtx)
+	defer func() { wd.Stop() }()
+
+	resp, fail := openUpstream(ctx, upstreamReq, sess.ChatID, &sess.AuthToken)
+	if fail != nil {
+		sink.Fail(fail)
+		return Usage{}
+	}
+	wd.Start()
+	defer func() { resp.Body.Close() }()
+	st := startStreamTrace(ctx)
+	defer func() { st.End(nil) }()
+
+	if !sink.Open() {
+		return Usage{}
+	}
+	metricActiveStreams.Add(1)
+	defer metricActiveStreams.Add(-1)
+
+	// 读取上游SSE流
+	reqLog.Debug("开始读取上游SSE流")
+	lineCount := 0
+	asm := sess.newAssembler(upstreamReq.Messages)
+	var finished bool
+	resumes := 0
+
+	for {
+		scanner := bufio.NewScanner(resp.Body)
+		var failure *upstreamFailure
+		for !sink.Gone() && scanner.Scan() {
+			line := scanner.Text()
+			lineCount++
+
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+
+			dataStr := strings.TrimPrefix(line, "data: ")
+			if dataStr == "" {
+				continue
+			}
+
+			reqLog.Debug("收到SSE数据", "line", lineCount, "data", dataStr)
+			wd.Event()
+
+			var upstreamData UpstreamData
+			if err := json.Unmarshal([]byte(dataStr), &upstreamData); err != nil {
+				reqLog.Debug("SSE数据解析失败", "error", err)
+				continue
+			}
+			st.Frame(upstreamData.Data.Phase)
+
+			// 错误检测：以错误事件结束下游流（或续写），而不是伪装成正常结束
+			if upstreamErr := upstreamData.upstreamError(); upstreamErr != nil {
+				reqLog.Warn("上游错误", "code", upstreamErr.Code, "detail", upstreamErr.Detail)
+				failure = upstreamFrameFailure(upstreamErr)
+				break
+			}
+
+			reqLog.Debug("解析成功", "type", upstreamData.Type, "phase", upstreamData.Data.Phase,
+				"length", len(upstreamData.Data.DeltaContent), "done", upstreamData.Data.Done)
+
+			d, done := asm.Feed(&upstreamData)
+			sink.Delta(d)
+
+			// 检查是否结束
+			if done {
+				reqLog.Debug("检测到流结束信号")
+				st.End(nil)
+				_, flush := tracer.Start(ctx, "downstream.flush")
+				sink.Delta(asm.Finish())
+				sink.Close(asm)
+				flush.End()
+				reqLog.Debug("流式响应完成", "lines", lineCount)
+				requestOutcomes.Inc(outcomeCompleted)
+				finished = true
+				break
+			}
+		}
+		if finished {
+			break
+		}
+		if sink.Gone() || parent.Err() != nil {
+			// 客户端已断开，取消上游请求
+			cancel()
+			reqLog.Info("客户端已取消请求，停止读取上游")
+			requestOutcomes.Inc(outcomeClientCancelled)
+			break
+		}
+
+		if failure == nil {
+			scanErr := scanner.Err()
+			if scanErr != nil {
+				reqLog.Debug("扫描器错误", "error", scanErr)
+			}
+			if t := upstreamTimeoutError(ctx, scanErr); t != nil {
+				reqLog.Warn("上游超时", "code", t.Code)
+				failure = &upstreamFailure{outcomeUpstreamTimeout, http.StatusGatewayTimeout, "timeout_error", t.Code, t.Message}
+			} else {
+				reqLog.Warn("上游流意外结束")
+				failure = errStreamInterrupted
+			}
+		}
+		st.End(failure)
+
+		// 上游中途断开：换token发送续写请求，继续写入同一个下游响应；超过总时长限制时不续写
+		if resumes < config().UpstreamResumeAttempts && failure.Code != errTotalTimeout.Code && asm.Resumable() {
+			resumes++
+			reqLog.Warn("上游流中断，发送续写请求", "code", failure.Code, "resume", resumes)
+			upstreamRetries.Inc("stream_resume")
+			sink.Delta(asm.Resume())
+			sink.Resumed(resumes)
+
+			resp.Body.Close()
+			wd.Stop()
+			ctx, wd = watchUpstream(streamCtx)
+			var next *http.Response
+			var fail *upstreamFailure
+			if len(upstreamReq.Files) == 0 {
+				upstreamPool.Release(sess.AuthToken)
+				sess.AuthToken, fail = selectAuthToken(streamCtx)
+			}
+			if fail == nil {
+				next, fail = openUpstream(ctx, continuationRequest(upstreamReq, asm.Content()), sess.ChatID, &sess.AuthToken)
+			}
+			if fail == nil {
+				resp = next
+				wd.Start()
+				st = startStreamTrace(ctx)
+				continue
+			}
+			failure = fail
+		}
+
+		sink.Delta(asm.Finish())
+		sink.Fail(failure)
+		break
+	}
+
+	return asm.Usage()
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ResponseFormat OpenAI response_format
+type ResponseFormat struct {
+	Type       string            `json:"type"` // text / json_object / json_schema
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat response_format.json_schema
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      bool            `json:"strict,omitempty"`
+}
+
+// structuredOutput 本次请求要求的结构化输出
+type structuredOutput struct {
+	Type   string
+	Name   string
+	Schema map[string]interface{} // json_object 时为 nil
+	raw    string                 // 注入提示词用的schema原文
+}
+
+// parseResponseFormat 解析 response_format，text 或未设置时返回 nil
+func parseResponseFormat(rf *ResponseFormat) (*structuredOutput, error) {
+	if rf == nil || rf.Type == "" || rf.Type == "text" {
+		return nil, nil
+	}
+	switch rf.Type {
+	case "json_object":
+		return &structuredOutput{Type: rf.Type}, nil
+	case "json_schema":
+		if rf.JSONSchema == nil || len(rf.JSONSchema.Schema) == 0 {
+			return nil, fmt.Errorf("response_format.json_schema.schema is required")
+		}
+		var schema map[string]interface{}
+		if err := json.Unmarshal(rf.JSONSchema.Schema, &schema); err != nil {
+			return nil, fmt.Errorf("response_format.json_schema.schema must be a JSON object: %v", err)
+		}
+		if key := schemaRefKeyword(schema); key != "" {
+			return nil, fmt.Errorf("response_format.json_schema.schema: %q is not supported, inline the referenced schemas", key)
+		}
+		var compact bytes.Buffer
+		json.Compact(&compact, rf.JSONSchema.Schema)
+		return &structuredOutput{Type: rf.Type, Name: rf.JSONSchema.Name, Schema: schema, raw: compact.String()}, nil
+	default:
+		return nil, fmt.Errorf("unsupported response_format type %q", rf.Type)
+	}
+}
+
+// Prompt 注入系统消息的输出格式说明
+func (so *structuredOutput) Prompt() string {
+	var b strings.Builder
+	b.WriteString("You must reply with a single valid JSON value and nothing else: no explanations, no markdown, no code fences.")
+	if so.Schema == nil {
+		b.WriteString(" The JSON value must be an object.")
+		return b.String()
+	}
+	if so.Name != "" {
+		fmt.Fprintf(&b, " The JSON must conform to the JSON Schema %q below.", so.Name)
+	} else {
+		b.WriteString(" The JSON must conform to the JSON Schema below.")
+	}
+	b.WriteString("\n<json_schema>\n")
+	b.WriteString(so.raw)
+	b.WriteString("\n</json_schema>")
+	return b.String()
+}
+
+// repairPrompt 校验失败后要求模型修正输出
+func (so *structuredOutput) repairPrompt(err error) string {
+	return fmt.Sprintf("Your previous reply was rejected: %v. Reply again with only the corrected JSON value, without code fences or any other text.", err)
+}
+
+var (
+	thinkBlockRe = regexp.MustCompile(`(?s)<think>.*?</think>|<details[^>]*>.*?</details>`)
+	codeFenceRe  = regexp.MustCompile("(?s)```[a-zA-Z]*\\s*\\n(.*?)\\n?```")
+)
+
+// Extract 从回答中取出JSON并校验，返回规范化后的JSON文本
+func (so *structuredOutput) Extract(content string) (string, error) {
+	text := strings.TrimSpace(thinkBlockRe.ReplaceAllString(content, ""))
+	if m := codeFenceRe.FindStringSubmatch(text); m != nil {
+		text = strings.TrimSpace(m[1])
+	}
+	start := strings.IndexAny(text, "{[")
+	if start < 0 {
+		return "", fmt.Errorf("no JSON value found in the reply")
+	}
+	dec := json.NewDecoder(strings.NewReader(text[start:]))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return "", fmt.Errorf("invalid JSON: %v", err)
+	}
+	raw := strings.TrimSpace(text[start : start+int(dec.InputOffset())])
+
+	if so.Schema == nil {
+		if _, ok := value.(map[string]interface{}); !ok {
+			return "", fmt.Errorf("the reply must be a JSON object")
+		}
+		return raw, nil
+	}
+	if err := validateJSONSchema(so.Schema, value, "$"); err != nil {
+		return "", fmt.Errorf("JSON does not match the schema: %v", err)
+	}
+	return raw, nil
+}
+
+// validateJSONSchema 按JSON Schema的常用子集校验：type、enum、const、properties、required、
+// additionalProperties、items、anyOf/oneOf/allOf、长度与数值范围
+func validateJSONSchema(schema map[string]interface{}, value interface{}, path string) error {
+	if t, ok := schema["type"]; ok {
+		var types []string
+		switch t := t.(type) {
+		case string:
+			types = []string{t}
+		case []interface{}:
+			for _, v := range t {
+				if s, ok := v.(string); ok {
+					types = append(types, s)
+				}
+			}
+		}
+		matched := false
+		for _, t := range types {
+			if jsonTypeMatches(t, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), jsonTypeName(value))
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value is not one of the allowed enum values", path)
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, value) {
+		return fmt.Errorf("%s: value does not match const", path)
+	}
+
+	for _, sub := range schemaList(schema["allOf"]) {
+		if err := validateJSONSchema(sub, value, path); err != nil {
+			return err
+		}
+	}
+	if subs := schemaList(schema["anyOf"]); len(subs) > 0 {
+		var firstErr error
+		for _, sub := range subs {
+			if err := validateJSONSchema(sub, value, path); err == nil {
+				firstErr = nil
+				break
+			} else if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return fmt.Errorf("%s: value does not match any of anyOf (%v)", path, firstErr)
+		}
+	}
+	if subs := schemaList(schema["oneOf"]); len(subs) > 0 {
+		n := 0
+		for _, sub := range subs {
+			if validateJSONSchema(sub, value, path) == nil {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("%s: value must match exactly one of oneOf, matched %d", path, n)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		props, _ := schema["properties"].(map[string]interface{})
+		for _, r := range schemaStrings(schema["required"]) {
+			if _, ok := v[r]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, r)
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if sub, ok := props[k].(map[string]interface{}); ok {
+				if err := validateJSONSchema(sub, v[k], path+"."+k); err != nil {
+					return err
+				}
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					return fmt.Errorf("%s: unexpected property %q", path, k)
+				}
+			case map[string]interface{}:
+				if err := validateJSONSchema(extra, v[k], path+"."+k); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if n, ok := schemaNumber(schema["minItems"]); ok && float64(len(v)) < n {
+			return fmt.Errorf("%s: expected at least %v items", path, n)
+		}
+		if n, ok := schemaNumber(schema["maxItems"]); ok && float64(len(v)) > n {
+			return fmt.Errorf("%s: expected at most %v items", path, n)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validateJSONSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := float64(len([]rune(v)))
+		if n, ok := schemaNumber(schema["minLength"]); ok && length < n {
+			return fmt.Errorf("%s: string shorter than %v", path, n)
+		}
+		if n, ok := schemaNumber(schema["maxLength"]); ok && length > n {
+			return fmt.Errorf("%s: string longer than %v", path, n)
+		}
+		if p, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(p); err == nil && !re.MatchString(v) {
+				return fmt.Errorf("%s: string does not match pattern %q", path, p)
+			}
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if n, ok := schemaNumber(schema["minimum"]); ok && f < n {
+			return fmt.Errorf("%s: value is less than minimum %v", path, n)
+		}
+		if n, ok := schemaNumber(schema["maximum"]); ok && f > n {
+			return fmt.Errorf("%s: value is greater than maximum %v", path, n)
+		}
+	}
+	return nil
+}
+
+func jsonTypeMatches(t string, value interface{}) bool {
+	switch t {
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := n.Float64()
+		return err == nil && f == math.Trunc(f)
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	default:
+		return jsonTypeName(value) == t
+	}
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// jsonEqual 比较两个JSON值（schema中的数字为 float64，输出中的数字为 json.Number）
+func jsonEqual(a, b interface{}) bool {
+	na, aok := jsonFloat(a)
+	nb, bok := jsonFloat(b)
+	if aok || bok {
+		return aok && bok && na == nb
+	}
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Equal(ja, jb)
+}
+
+func jsonFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// schemaRefKeyword 查找校验器不支持的引用关键字（$ref、$defs、definitions），没有时返回空串。
+// properties 下的键是属性名，不当作关键字检查
+func schemaRefKeyword(schema map[string]interface{}) string {
+	for _, key := range []string{"$ref", "$defs", "definitions"} {
+		if _, ok := schema[key]; ok {
+			return key
+		}
+	}
+	for key, v := range schema {
+		var subs []map[string]interface{}
+		switch key {
+		case "properties", "patternProperties":
+			props, _ := v.(map[string]interface{})
+			for _, p := range props {
+				if m, ok := p.(map[string]interface{}); ok {
+					subs = append(subs, m)
+				}
+			}
+		case "items", "additionalProperties", "not":
+			if m, ok := v.(map[string]interface{}); ok {
+				subs = append(subs, m)
+			}
+		case "anyOf", "oneOf", "allOf", "prefixItems":
+			subs = schemaList(v)
+		}
+		for _, sub := range subs {
+			if found := schemaRefKeyword(sub); found != "" {
+				return found
+			}
+		}
+	}
+	return ""
+}
+
+func schemaNumber(v interface{}) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+func schemaStrings(v interface{}) []string {
+	list, _ := v.([]interface{})
+	var out []string
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func schemaList(v interface{}) []map[string]interface{} {
+	list, _ := v.([]interface{})
+	var out []map[string]interface{}
+	for _, item := range list {
+		if m, ok := item.(map[string]interface{}); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// addUsage 累加多次上游调用的用量
+func addUsage(a, b Usage) Usage {
+	sum := Usage{
+		PromptTokens:     a.PromptTokens + b.PromptTokens,
+		CompletionTokens: a.CompletionTokens + b.CompletionTokens,
+		TotalTokens:      a.TotalTokens + b.TotalTokens,
+	}
+	if a.CompletionTokensDetails != nil || b.CompletionTokensDetails != nil {
+		sum.CompletionTokensDetails = &CompletionTokensDetails{}
+		for _, d := range []*CompletionTokensDetails{a.CompletionTokensDetails, b.CompletionTokensDetails} {
+			if d != nil {
+				sum.CompletionTokensDetails.ReasoningTokens += d.ReasoningTokens
+			}
+		}
+	}
+	return sum
+}
+
+// handleStructuredResponse 结构化输出：完整收集上游回答，提取并校验JSON，失败时带修正提示重试。
+// 流式请求同样先缓冲，校验通过后才发送内容；第一次成功拿到上游回答后才写出SSE头部，
+// 在此之前的上游失败与非流式请求一样以对应的状态码返回。
+func handleStructuredResponse(ctx context.Context, w http.ResponseWriter, upstreamReq UpstreamRequest, sess *chatSession, so *structuredOutput, stream bool) Usage {
+	reqLog := logger(ctx).With("chat_id", sess.ChatID)
+	reqLog.Debug("开始处理结构化输出", "type", so.Type, "stream", stream)
+
+	var sse *structuredStream
+
+	var total Usage
+	respond := func(msg Message, finishReason string) Usage {
+		requestOutcomes.Inc(outcomeCompleted)
+		if sse != nil {
+			sse.send(msg, finishReason, total)
+		} else {
+			writeCompletion(w, sess, msg, finishReason, total)
+		}
+		return total
+	}
+
+	req := upstreamReq
+	var lastErr error
+	for attempt := 0; attempt <= config().JSONRepairRetries; attempt++ {
+		if attempt > 0 && sess.ToolParser != nil {
+			sess.ToolParser = newToolCallParser(sess.Log)
+		}
+		asm, fail := collectUpstream(ctx, req, sess)
+		if fail != nil {
+			if sse != nil {
+				fail.writeSSE(sse.w)
+			} else {
+				fail.write(w)
+			}
+			return total
+		}
+		if stream && sse == nil {
+			if sse = newStructuredStream(w, sess); sse == nil {
+				return total
+			}
+		}
+		total = addUsage(total, asm.Usage())
+		msg := asm.Message()
+
+		// 模型选择调用工具时原样返回
+		if len(msg.ToolCalls) > 0 {
+			return respond(msg, asm.FinishReason())
+		}
+
+		content, err := so.Extract(msg.Content)
+		if err == nil {
+			reqLog.Debug("结构化输出校验通过", "attempt", attempt+1)
+			msg.Content = content
+			return respond(msg, asm.FinishReason())
+		}
+		lastErr = err
+		reqLog.Info("结构化输出校验失败", "attempt", attempt+1, "error", err)
+
+		// 带上本次回答与修正提示重新请求
+		req.Messages = append(append([]Message{}, req.Messages...),
+			Message{Role: "assistant", Content: msg.Content},
+			Message{Role: "user", Content: so.repairPrompt(err)})
+		req.ID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+
+	message := fmt.Sprintf("Model output failed JSON validation after %d attempts: %v", config().JSONRepairRetries+1, lastErr)
+	requestOutcomes.Inc(outcomeUpstreamError)
+	if sse != nil {
+		writeSSEError(w, "api_error", "json_validation_failed", message)
+	} else {
+		writeOpenAIError(w, http.StatusBadGateway, "api_error", "json_validation_failed", message)
+	}
+	return total
+}
+
+// structuredStream 结构化输出的流式响应：先发送 role chunk，校验通过后一次性发送内容
+type structuredStream struct {
+	w    http.ResponseWriter
+	sess *chatSession
+}
+
+func newStructuredStream(w http.ResponseWriter, sess *chatSession) *structuredStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	s := &structuredStream{w: w, sess: sess}
+	if err := writeSSEChunk(w, s.chunk(Delta{Role: "assistant"}, "")); err != nil {
+		sess.Log.Debug("写入下游失败，客户端可能已断开", "error", err)
+		requestOutcomes.Inc(outcomeClientCancelled)
+		return nil
+	}
+	return s
+}
+
+func (s *structuredStream) chunk(delta Delta, finishReason string) OpenAIResponse {
+	return OpenAIResponse{
+		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
+		Object:  "chat.completion.chunk",
+		Created: time.Now().Unix(),
+		Model:   s.sess.Model,
+		Choices: []Choice{{Index: 0, Delta: delta, FinishReason: finishReason}},
+	}
+}
+
+// send 发送校验通过的完整结果
+func (s *structuredStream) send(msg Message, finishReason string, usage Usage) {
+	var chunks []OpenAIResponse
+	if msg.ReasoningContent != "" {
+		chunks = append(chunks, s.chunk(Delta{ReasoningContent: msg.ReasoningContent}, ""))
+	}
+	if msg.Content != "" {
+		chunks = append(chunks, s.chunk(Delta{Content: msg.Content}, ""))
+	}
+	if len(msg.ToolCalls) > 0 {
+		calls := make([]ToolCall, len(msg.ToolCalls))
+		for i, call := range msg.ToolCalls {
+			index := i
+			call.Index = &index
+			calls[i] = call
+		}
+		chunks = append(chunks, s.chunk(Delta{ToolCalls: calls}, ""))
+	}
+	chunks = append(chunks, s.chunk(Delta{}, finishReason))
+	if s.sess.IncludeUsage {
+		usageChunk := s.chunk(Delta{}, "")
+		usageChunk.Choices = []Choice{}
+		usageChunk.Usage = &usage
+		chunks = append(chunks, usageChunk)
+	}
+	for _, chunk := range chunks {
+		if err := writeSSEChunk(s.w, chunk); err != nil {
+			s.sess.Log.Debug("写入下游失败，客户端可能已断开", "error", err)
+			return
+		}
+	}
+	fmt.Fprintf(s.w, "data: [DONE]\n\n")
+	http.NewResponseController(s.w).Flush()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// mustSchemaOutput 用schema原文构造 json_schema 结构化输出
+func mustSchemaOutput(t *testing.T, schema string) *structuredOutput {
+	t.Helper()
+	so, err := parseResponseFormat(&ResponseFormat{
+		Type:       "json_schema",
+		JSONSchema: &JSONSchemaFormat{Name: "test", Schema: json.RawMessage(schema)},
+	})
+	if err != nil {
+		t.Fatalf("parseResponseFormat: %v", err)
+	}
+	return so
+}
+
+func TestStructuredExtract(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"bare object", `{"a":1}`, `{"a":1}`},
+		{"surrounding whitespace", "\n  {\"a\": 1}  \n", `{"a": 1}`},
+		{"fenced json", "```json\n{\"a\":1}\n```", `{"a":1}`},
+		{"fenced without language", "```\n{\"a\":1}\n```", `{"a":1}`},
+		{"fence with text around", "Here you go:\n```json\n{\"a\":1}\n```\nDone.", `{"a":1}`},
+		{"leading text", `Sure! {"a":1}`, `{"a":1}`},
+		{"trailing text", `{"a":1} Hope this helps.`, `{"a":1}`},
+		{"trailing second object", `{"a":1}{"b":2}`, `{"a":1}`},
+		{"think block removed", "<think>maybe {\"x\":0}</think>{\"a\":1}", `{"a":1}`},
+		{"details block removed", "<details type=\"reasoning\">\n> {\"x\":0}\n</details>\n{\"a\":1}", `{"a":1}`},
+		{"braces inside strings", `{"a":"}{"} tail`, `{"a":"}{"}`},
+	}
+	so := &structuredOutput{Type: "json_object"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := so.Extract(tt.content)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStructuredExtractErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string // 为空时按 json_object 处理
+		content string
+		wantErr string
+	}{
+		{"no json", "", "I cannot answer that.", "no JSON value found"},
+		{"truncated json", "", `{"a":`, "invalid JSON"},
+		{"array for json_object", "", `[1,2]`, "must be a JSON object"},
+		{"array allowed by schema", `{"type":"array"}`, `[1,2]`, ""},
+		{"schema mismatch", `{"type":"object","required":["a"]}`, `{"b":1}`, "does not match the schema"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			so := &structuredOutput{Type: "json_object"}
+			if tt.schema != "" {
+				so = mustSchemaOutput(t, tt.schema)
+			}
+			_, err := so.Extract(tt.content)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateJSONSchema(t *testing.T) {
+	const person = `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"role": {"enum": ["admin", "user"]},
+			"address": {
+				"type": "object",
+				"properties": {"city": {"type": "string"}, "zip": {"type": "string", "pattern": "^[0-9]{5}$"}},
+				"required": ["city"],
+				"additionalProperties": false
+			},
+			"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2}
+		},
+		"required": ["name", "age"]
+	}`
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string // 为空表示应通过
+	}{
+		{"valid", `{"name":"a","age":3,"role":"user","address":{"city":"x","zip":"12345"},"tags":["t"]}`, ""},
+		{"wrong top-level type", `["a"]`, "$: expected object, got array"},
+		{"wrong property type", `{"name":1,"age":3}`, "$.name: expected string, got number"},
+		{"integer with fraction", `{"name":"a","age":3.5}`, "$.age: expected integer, got number"},
+		{"missing required", `{"name":"a"}`, `$: missing required property "age"`},
+		{"enum mismatch", `{"name":"a","age":3,"role":"root"}`, "$.role: value is not one of the allowed enum values"},
+		{"below minimum", `{"name":"a","age":-1}`, "$.age: value is less than minimum 0"},
+		{"string too short", `{"name":"","age":3}`, "$.name: string shorter than 1"},
+		{"nested missing required", `{"name":"a","age":3,"address":{}}`, `$.address: missing required property "city"`},
+		{"nested wrong type", `{"name":"a","age":3,"address":{"city":7}}`, "$.address.city: expected string, got number"},
+		{"nested extra property", `{"name":"a","age":3,"address":{"city":"x","street":"y"}}`, `$.address: unexpected property "street"`},
+		{"nested pattern", `{"name":"a","age":3,"address":{"city":"x","zip":"abc"}}`, `$.address.zip: string does not match pattern`},
+		{"array item type", `{"name":"a","age":3,"tags":[1]}`, "$.tags[0]: expected string, got number"},
+		{"too many items", `{"name":"a","age":3,"tags":["a","b","c"]}`, "$.tags: expected at most 2 items"},
+	}
+	so := mustSchemaOutput(t, person)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec := json.NewDecoder(strings.NewReader(tt.value))
+			dec.UseNumber()
+			var value interface{}
+			if err := dec.Decode(&value); err != nil {
+				t.Fatalf("bad test value: %v", err)
+			}
+			err := validateJSONSchema(so.Schema, value, "$")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want prefix %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateJSONSchemaCombinators(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		ok     bool
+	}{
+		{"anyOf match", `{"anyOf":[{"type":"string"},{"type":"integer"}]}`, `3`, true},
+		{"anyOf no match", `{"anyOf":[{"type":"string"},{"type":"integer"}]}`, `true`, false},
+		{"oneOf exactly one", `{"oneOf":[{"type":"string"},{"type":"integer"}]}`, `"a"`, true},
+		{"oneOf two matches", `{"oneOf":[{"type":"number"},{"type":"integer"}]}`, `3`, false},
+		{"allOf", `{"allOf":[{"type":"integer"},{"minimum":5}]}`, `3`, false},
+		{"const", `{"const":"x"}`, `"x"`, true},
+		{"type list with null", `{"type":["string","null"]}`, `null`, true},
+		{"enum number", `{"enum":[1,2]}`, `2.0`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			so := mustSchemaOutput(t, tt.schema)
+			dec := json.NewDecoder(strings.NewReader(tt.value))
+			dec.UseNumber()
+			var value interface{}
+			if err := dec.Decode(&value); err != nil {
+				t.Fatalf("bad test value: %v", err)
+			}
+			if err := validateJSONSchema(so.Schema, value, "$"); (err == nil) != tt.ok {
+				t.Errorf("got error %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseResponseFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		rf      *ResponseFormat
+		wantErr string // 为空表示应通过
+	}{
+		{"nil", nil, ""},
+		{"text", &ResponseFormat{Type: "text"}, ""},
+		{"json_object", &ResponseFormat{Type: "json_object"}, ""},
+		{"unsupported type", &ResponseFormat{Type: "xml"}, "unsupported response_format type"},
+		{"missing schema", &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Name: "x"}}, "schema is required"},
+		{"schema not an object", &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Schema: json.RawMessage(`[1]`)}}, "must be a JSON object"},
+		{"top-level $ref", &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Schema: json.RawMessage(`{"$ref":"#/$defs/a","$defs":{"a":{}}}`)}}, "is not supported"},
+		{"nested $ref", &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Schema: json.RawMessage(`{"type":"object","properties":{"a":{"items":{"$ref":"#/definitions/b"}}}}`)}}, `"$ref" is not supported`},
+		{"definitions", &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Schema: json.RawMessage(`{"anyOf":[{"definitions":{}}]}`)}}, `"definitions" is not supported`},
+		{"property named like a keyword", &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Schema: json.RawMessage(`{"type":"object","properties":{"definitions":{"type":"string"}}}`)}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseResponseFormat(tt.rf)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import "strings"
+
+// 上游思考内容中出现的标签
+const (
+	tagDetailsOpen  = "<details"
+	tagDetailsClose = "</details>"
+	tagSummaryOpen  = "<summary>"
+	tagSummaryClose = "</summary>"
+)
+
+// 需要直接丢弃的残留标签
+var droppedThinkingTags = []string{"</thinking>", "<Full>", "</Full>"}
+
+// maxDetailsTagLen <details ...> 开标签的最大长度，超过时按普通文本处理
+const maxDetailsTagLen = 256
+
+// thinkingParser 上游思考内容的增量解析器
+//
+// 上游以 <details><summary>…</summary>\n> 引用行…</details> 的形式输出思考过程，
+// 标签和行首的 "> " 可能被拆到相邻的两个SSE帧中。解析器跨帧保存状态，
+// 按 THINK_TAGS_MODE 输出：think 转为 <think> 标签，strip 去掉标签，raw 保留 <details> 标签。
+// <summary> 与引用前缀在所有模式下都会去掉。
+type thinkingParser struct {
+	mode        string
+	pending     string // 尚未确定含义的内容（可能是被拆开的标签或行首前缀）
+	inSummary   bool
+	atLineStart bool
+	trimLeading bool // 开头与开标签之后的空白不输出
+	opened      bool
+	closed      bool
+	sentEdit    bool // 已输出 EditContent 中的最初回答片段
+}
+
+// newThinkingParser 创建解析器，mode 取值同 THINK_TAGS_MODE
+func newThinkingParser(mode string) *thinkingParser {
+	return &thinkingParser{mode: mode, atLineStart: true, trimLeading: true}
+}
+
+// Feed 输入一段 thinking 阶段的增量内容，返回可以输出的部分
+func (p *thinkingParser) Feed(s string) string {
+	p.pending += s
+	var out strings.Builder
+	for p.pending != "" {
+		if p.inSummary {
+			end := strings.Index(p.pending, tagSummaryClose)
+			if end < 0 {
+				// 摘要内容全部丢弃，只保留可能被拆开的结束标签
+				keep := partialSuffix(p.pending, tagSummaryClose)
+				p.pending = p.pending[len(p.pending)-keep:]
+				break
+			}
+			p.pending = p.pending[end+len(tagSummaryClose):]
+			p.inSummary = false
+			continue
+		}
+
+		if p.atLineStart && p.pending[0] == '>' {
+			// 引用前缀 "> "，只有一个 ">" 时等下一帧再判断
+			if len(p.pending) == 1 {
+				break
+			}
+			if p.pending[1] == ' ' {
+				p.pending = p.pending[2:]
+			} else {
+				p.pending = p.pending[1:]
+			}
+			p.atLineStart = false
+			continue
+		}
+
+		if p.pending[0] == '<' {
+			n, partial := p.matchTag(p.pending)
+			if partial {
+				break
+			}
+			if n > 0 {
+				p.handleTag(p.pending[:n], &out)
+				p.pending = p.pending[n:]
+				continue
+			}
+		}
+
+		// 普通文本：输出到下一个可能的标签或换行（含）为止
+		end := len(p.pending)
+		if i := strings.IndexByte(p.pending, '\n'); i >= 0 {
+			end = i + 1
+		}
+		if i := strings.IndexByte(p.pending[1:], '<'); i >= 0 && i+1 < end {
+			end = i + 1
+		}
+		text := p.pending[:end]
+		p.pending = p.pending[len(text):]
+		p.emit(&out, text)
+	}
+	return out.String()
+}
+
+// Close 思考阶段结束时调用，输出剩余内容并补齐未闭合的标签
+func (p *thinkingParser) Close() string {
+	var out strings.Builder
+	if !p.inSummary && p.pending != "" {
+		p.emit(&out, p.pending)
+	}
+	p.pending = ""
+	p.inSummary = false
+	if p.opened && !p.closed {
+		p.handleTag(tagDetailsClose, &out)
+	}
+	return out.String()
+}
+
+// Frame 处理一个上游帧，返回需要输出的思考内容与回答内容
+//
+// 进入 answer 阶段时上游不会再以增量发送 </details>，而是在 EditContent 中给出完整的思考块，
+// 其后跟着最初的回答片段，因此在这里结束思考并取出该片段（只取一次）。
+func (p *thinkingParser) Frame(phase, delta, edit string) (reasoning, answer string) {
+	if phase == "thinking" {
+		return p.Feed(delta), ""
+	}
+	reasoning = p.Close()
+	if !p.sentEdit && edit != "" && phase == "answer" {
+		if s, ok := answerFromEditContent(edit); ok && s != "" {
+			answer = s
+			p.sentEdit = true
+		}
+	}
+	return reasoning, answer + delta
+}
+
+// matchTag 判断 s 开头是否为已知标签，返回标签长度；partial 表示可能是被拆开的标签
+func (p *thinkingParser) matchTag(s string) (n int, partial bool) {
+	if strings.HasPrefix(s, tagDetailsOpen) {
+		end := strings.IndexByte(s, '>')
+		if end < 0 {
+			return 0, len(s) < maxDetailsTagLen
+		}
+		return end + 1, false
+	}
+	for _, tag := range append([]string{tagDetailsClose, tagSummaryOpen, tagSummaryClose, tagDetailsOpen}, droppedThinkingTags...) {
+		if strings.HasPrefix(s, tag) {
+			return len(tag), false
+		}
+		if strings.HasPrefix(tag, s) {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+func (p *thinkingParser) handleTag(tag string, out *strings.Builder) {
+	switch {
+	case strings.HasPrefix(tag, tagDetailsOpen):
+		p.opened = true
+		p.trimLeading = true
+		switch p.mode {
+		case "think":
+			out.WriteString("<think>")
+		case "raw":
+			out.WriteString(tag)
+		}
+	case tag == tagDetailsClose:
+		p.closed = true
+		switch p.mode {
+		case "think":
+			out.WriteString("</think>")
+		case "raw":
+			out.WriteString(tag)
+		}
+	case tag == tagSummaryOpen:
+		p.inSummary = true
+	}
+	// </summary> 单独出现与其他残留标签直接丢弃
+}
+
+func (p *thinkingParser) emit(out *strings.Builder, text string) {
+	p.atLineStart = strings.HasSuffix(text, "\n")
+	if p.trimLeading {
+		text = strings.TrimLeft(text, " \t\r\n")
+		if text == "" {
+			return
+		}
+		p.trimLeading = false
+	}
+	out.WriteString(text)
+}
+
+// answerFromEditContent 从 answer 阶段的 EditContent 中取出 </details> 之后的最初回答片段
+func answerFromEditContent(edit string) (string, bool) {
+	idx := strings.Index(edit, tagDetailsClose)
+	if idx < 0 {
+		return "", false
+	}
+	return strings.TrimLeft(edit[idx+len(tagDetailsClose):], "\n"), true
+}
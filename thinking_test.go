@@ -0,0 +1,220 @@
+package main
+
+import "testing"
+
+// 录制的上游 thinking 阶段帧（delta_content）
+var recordedThinkingFrames = []string{
+	"<details type=\"reasoning\" done=\"false\">\n<summary>Thinking…</summary>\n> Let me",
+	" think.\n> Second line",
+}
+
+// 录制的进入 answer 阶段的 EditContent：完整思考块后跟着最初的回答片段
+const recordedEditContent = "<details type=\"reasoning\" done=\"true\" duration=\"3\">\n<summary>Thought for 3 seconds</summary>\n> Let me think.\n> Second line\n</details>\nHello"
+
+// feedAll 依次输入各帧并在最后调用 Close，返回全部输出
+func feedAll(mode string, frames []string) string {
+	p := newThinkingParser(mode)
+	var out string
+	for _, f := range frames {
+		out += p.Feed(f)
+	}
+	return out + p.Close()
+}
+
+func TestThinkingParserSplitFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []string
+		want   string
+	}{
+		{
+			name:   "details open split",
+			frames: []string{"<det", "ails type=\"reasoning\">\n> a"},
+			want:   "<think>a</think>",
+		},
+		{
+			name:   "details close split",
+			frames: []string{"<details>\n> a\n> b", "</deta", "ils>"},
+			want:   "<think>a\nb</think>",
+		},
+		{
+			name:   "summary split",
+			frames: []string{"<details>\n<sum", "mary>Thinking", "…</sum", "mary>\n> x"},
+			want:   "<think>x</think>",
+		},
+		{
+			name:   "quote prefix split after marker",
+			frames: []string{"<details>\n> first\n>", " second"},
+			want:   "<think>first\nsecond</think>",
+		},
+		{
+			name:   "quote prefix split before marker",
+			frames: []string{"<details>\n> first\n", "> second"},
+			want:   "<think>first\nsecond</think>",
+		},
+		{
+			name:   "quote prefix without space",
+			frames: []string{"<details>\n>x"},
+			want:   "<think>x</think>",
+		},
+		{
+			name:   "less-than that is not a tag",
+			frames: []string{"<details>\n> 1 <", " 2"},
+			want:   "<think>1 < 2</think>",
+		},
+		{
+			name:   "dropped leftover tags",
+			frames: []string{"<details>\n> a<Full>b</Full></thinking>"},
+			want:   "<think>ab</think>",
+		},
+		{
+			name:   "recorded frames",
+			frames: recordedThinkingFrames,
+			want:   "<think>Let me think.\nSecond line</think>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := feedAll("think", tt.frames); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 录制的内容在任意位置拆成两帧，输出都应与不拆分时相同
+func TestThinkingParserEverySplitPoint(t *testing.T) {
+	whole := recordedThinkingFrames[0] + recordedThinkingFrames[1] + "\n</details>"
+	for _, mode := range []string{"think", "strip", "raw"} {
+		want := feedAll(mode, []string{whole})
+		for i := 1; i < len(whole); i++ {
+			if got := feedAll(mode, []string{whole[:i], whole[i:]}); got != want {
+				t.Fatalf("mode %s, split at %d (%q | %q): got %q, want %q", mode, i, whole[:i], whole[i:], got, want)
+			}
+		}
+	}
+}
+
+func TestThinkingParserModes(t *testing.T) {
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"think", "<think>Let me think.\nSecond line</think>"},
+		{"strip", "Let me think.\nSecond line"},
+		{"raw", "<details type=\"reasoning\" done=\"false\">Let me think.\nSecond line</details>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			if got := feedAll(tt.mode, recordedThinkingFrames); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThinkingParserClose(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		frames []string
+		want   string
+	}{
+		{"unclosed block think", "think", []string{"<details>\n> abc"}, "<think>abc</think>"},
+		{"unclosed block strip", "strip", []string{"<details>\n> abc"}, "abc"},
+		{"unclosed block raw", "raw", []string{"<details type=\"reasoning\">\n> abc"}, "<details type=\"reasoning\">abc</details>"},
+		{"unclosed summary", "think", []string{"<details>\n<summary>unfinished"}, "<think></think>"},
+		{"pending quote marker", "think", []string{"<details>\n> a\n>"}, "<think>a\n></think>"},
+		{"already closed", "think", []string{"<details>\n> a\n</details>"}, "<think>a\n</think>"},
+		{"no details block", "think", []string{"plain text"}, "plain text"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := feedAll(tt.mode, tt.frames); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThinkingParserFrame(t *testing.T) {
+	type frame struct{ phase, delta, edit string }
+	tests := []struct {
+		name          string
+		mode          string
+		frames        []frame
+		wantReasoning string
+		wantAnswer    string
+	}{
+		{
+			name: "edit content ends thinking",
+			mode: "think",
+			frames: []frame{
+				{"thinking", recordedThinkingFrames[0], ""},
+				{"thinking", recordedThinkingFrames[1], ""},
+				{"answer", "", recordedEditContent},
+				{"answer", " world", ""},
+			},
+			wantReasoning: "<think>Let me think.\nSecond line</think>",
+			wantAnswer:    "Hello world",
+		},
+		{
+			name: "edit content used once",
+			mode: "strip",
+			frames: []frame{
+				{"thinking", recordedThinkingFrames[0], ""},
+				{"answer", "", recordedEditContent},
+				{"answer", "!", recordedEditContent},
+			},
+			wantReasoning: "Let me",
+			wantAnswer:    "Hello!",
+		},
+		{
+			name: "edit content without details",
+			mode: "think",
+			frames: []frame{
+				{"thinking", "<details>\n> a", ""},
+				{"answer", "Hi", "no thinking block here"},
+			},
+			wantReasoning: "<think>a</think>",
+			wantAnswer:    "Hi",
+		},
+		{
+			name: "details closed in thinking phase",
+			mode: "raw",
+			frames: []frame{
+				{"thinking", "<details>\n> a\n</details>", ""},
+				{"answer", "", "<details>\n> a\n</details>\nHello"},
+			},
+			wantReasoning: "<details>a\n</details>",
+			wantAnswer:    "Hello",
+		},
+		{
+			name: "edit content outside answer phase",
+			mode: "think",
+			frames: []frame{
+				{"thinking", "<details>\n> a", ""},
+				{"other", "", recordedEditContent},
+			},
+			wantReasoning: "<think>a</think>",
+			wantAnswer:    "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newThinkingParser(tt.mode)
+			var reasoning, answer string
+			for _, f := range tt.frames {
+				r, a := p.Frame(f.phase, f.delta, f.edit)
+				reasoning += r
+				answer += a
+			}
+			if reasoning != tt.wantReasoning {
+				t.Errorf("reasoning = %q, want %q", reasoning, tt.wantReasoning)
+			}
+			if answer != tt.wantAnswer {
+				t.Errorf("answer = %q, want %q", answer, tt.wantAnswer)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamTimeout 上游超时错误，Code 用于返回给客户端的错误码
+type upstreamTimeout struct {
+	Code    string
+	Message string
+}
+
+func (e *upstreamTimeout) Error() string {
+	return e.Message
+}
+
+var (
+	errConnectTimeout    = &upstreamTimeout{"upstream_connect_timeout", "Timed out connecting to upstream"}
+	errFirstEventTimeout = &upstreamTimeout{"upstream_first_byte_timeout", "Upstream did not send the first event in time"}
+	errIdleTimeout       = &upstreamTimeout{"upstream_idle_timeout", "Upstream stream stalled: no event received in time"}
+	errTotalTimeout      = &upstreamTimeout{"upstream_total_timeout", "Upstream response exceeded the overall time limit"}
+)
+
+// upstreamTransport 上游共享的连接池，连接阶段受 UPSTREAM_CONNECT_TIMEOUT 限制
+var upstreamTransport http.RoundTripper
+
+// upstreamClient 上游请求使用的客户端；不设置总超时，由 upstreamWatchdog 按事件控制
+var upstreamClient *http.Client
+
+// initUpstreamClient 根据配置创建上游客户端
+func initUpstreamClient() {
+	dialer := &net.Dialer{Timeout: config().UpstreamConnectTimeout, KeepAlive: 30 * time.Second}
+	upstreamTransport = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: config().UpstreamConnectTimeout,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	upstreamClient = &http.Client{Transport: upstreamTransport}
+}
+
+// limitUpstreamTotal 为一次下游请求设置上游总时长上限，超时时以 errTotalTimeout 作为 cause 取消；
+// 同一下游请求的重试与续写共用这一个上限
+func limitUpstreamTotal(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d := config().UpstreamTotalTimeout; d > 0 {
+		return context.WithTimeoutCause(ctx, d, errTotalTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// upstreamWatchdog 监控上游流：首个事件超时与事件间空闲超时
+type upstreamWatchdog struct {
+	cancel   context.CancelCauseFunc
+	timer    *time.Timer
+	gotEvent atomic.Bool
+}
+
+// watchUpstream 返回受监控的 context；超时时以对应的 upstreamTimeout 作为 cause 取消。
+// 总时长上限由调用方通过 limitUpstreamTotal 设置在 ctx 上
+func watchUpstream(ctx context.Context) (context.Context, *upstreamWatchdog) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	wd := &upstreamWatchdog{cancel: cancel}
+	wd.timer = time.AfterFunc(time.Hour, func() {
+		if wd.gotEvent.Load() {
+			cancel(errIdleTimeout)
+		} else {
+			cancel(errFirstEventTimeout)
+		}
+	})
+	wd.timer.Stop()
+	return ctx, wd
+}
+
+// Start 收到上游响应头后开始首个事件计时；重试与退避等待不计入首个事件超时
+func (wd *upstreamWatchdog) Start() {
+	wd.arm(config().UpstreamFirstByteTimeout)
+}
+
+// Event 收到一个上游事件，重置空闲计时
+func (wd *upstreamWatchdog) Event() {
+	wd.gotEvent.Store(true)
+	wd.arm(config().UpstreamIdleTimeout)
+}
+
+// arm 重新设置计时器，d<=0 表示不限制
+func (wd *upstreamWatchdog) arm(d time.Duration) {
+	if d > 0 {
+		wd.timer.Reset(d)
+	} else {
+		wd.timer.Stop()
+	}
+}
+
+// Stop 停止所有计时器并释放 context
+func (wd *upstreamWatchdog) Stop() {
+	wd.timer.Stop()
+	wd.cancel(nil)
+}
+
+// awaitHeaders 单次上游请求等待响应头的超时，超时时以 errFirstEventTimeout 作为 cause 取消；
+// 收到响应头后调用 stop 停止计时，返回 false 说明已经超时。
+// 本次请求结束后调用 cancel 释放 attemptCtx：失败时立即调用，成功时在关闭响应体时调用
+func awaitHeaders(ctx context.Context) (attemptCtx context.Context, stop func() bool, cancel context.CancelFunc) {
+	attemptCtx, cancelCause := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(config().UpstreamFirstByteTimeout, func() {
+		cancelCause(errFirstEventTimeout)
+	})
+	return attemptCtx, timer.Stop, func() {
+		timer.Stop()
+		cancelCause(nil)
+	}
+}
+
+// cancelOnClose 关闭响应体时一并释放该次请求的 context
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// upstreamTimeoutError 判断错误是否由上游超时引起
+func upstreamTimeoutError(ctx context.Context, err error) *upstreamTimeout {
+	var timeout *upstreamTimeout
+	if errors.As(context.Cause(ctx), &timeout) {
+		return timeout
+	}
+	var netErr net.Error
+	if err != nil && errors.As(err, &netErr) && netErr.Timeout() {
+		return errConnectTimeout
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 令牌池选择策略
+const (
+	strategyRoundRobin    = "round_robin"
+	strategyLeastInFlight = "least_inflight"
+	strategyWeighted      = "weighted"
+)
+
+// poolToken 令牌池中的单个上游token及其状态
+type poolToken struct {
+	Token  string
+	Weight int
+
+	inFlight      int
+	failures      int // 连续失败次数，用于计算冷却时间
+	cooldownUntil time.Time
+	lastStatus    int
+	requests      int64
+	lastUsed      time.Time
+	current       int // 平滑加权轮询的当前权重
+}
+
+func (t *poolToken) healthy(now time.Time) bool {
+	return !now.Before(t.cooldownUntil)
+}
+
+// tokenPool 上游token池，支持轮询、最少并发、加权三种选择策略
+type tokenPool struct {
+	mu           sync.Mutex
+	tokens       []*poolToken
+	byToken      map[string]*poolToken
+	strategy     string
+	next         int
+	cooldownBase time.Duration
+	cooldownMax  time.Duration
+}
+
+// 全局令牌池
+var upstreamPool *tokenPool
+
+// newTokenPool 根据 "token[:weight]" 形式的配置创建令牌池
+func newTokenPool(specs []string, strategy string, cooldownBase, cooldownMax time.Duration) *tokenPool {
+	p := &tokenPool{byToken: map[string]*poolToken{}}
+	p.Update(specs, strategy, cooldownBase, cooldownMax)
+	return p
+}
+
+// Update 热加载时替换池中的token与策略；仍在池中的token保留冷却、并发等状态，
+// 移除的token上进行中的请求正常结束，Release 时忽略
+func (p *tokenPool) Update(specs []string, strategy string, cooldownBase, cooldownMax time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tokens := make([]*poolToken, 0, len(specs))
+	byToken := map[string]*poolToken{}
+	for _, spec := range specs {
+		token, weight := parseTokenSpec(spec)
+		if token == "" || byToken[token] != nil {
+			continue
+		}
+		t := p.byToken[token]
+		if t == nil {
+			t = &poolToken{Token: token}
+		}
+		t.Weight = weight
+		tokens = append(tokens, t)
+		byToken[token] = t
+	}
+	p.tokens = tokens
+	p.byToken = byToken
+	p.strategy = strategy
+	p.cooldownBase = cooldownBase
+	p.cooldownMax = cooldownMax
+}
+
+// parseTokenSpec 解析 "token" 或 "token:weight"
+func parseTokenSpec(spec string) (string, int) {
+	spec = strings.TrimSpace(spec)
+	if i := strings.LastIndex(spec, ":"); i > 0 {
+		if w, err := strconv.Atoi(spec[i+1:]); err == nil && w > 0 {
+			return spec[:i], w
+		}
+	}
+	return spec, 1
+}
+
+// loadTokenSpecs 汇总配置文件、环境变量与token文件中的token配置
+func loadTokenSpecs(c *Config) ([]string, error) {
+	specs := append([]string(nil), c.Tokens...)
+	for _, s := range strings.Split(c.UpstreamTokens, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			specs = append(specs, s)
+		}
+	}
+	if c.UpstreamTokensFile != "" {
+		f, err := os.Open(c.UpstreamTokensFile)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			specs = append(specs, line)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("read %s: %v", c.UpstreamTokensFile, err)
+		}
+	}
+	// 未配置令牌池时沿用单个 UPSTREAM_TOKEN
+	if len(specs) == 0 && c.UpstreamToken != "" {
+		specs = append(specs, c.UpstreamToken)
+	}
+	return specs, nil
+}
+
+// Strategy 当前的选择策略
+func (p *tokenPool) Strategy() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.strategy
+}
+
+// Size 池中token数量
+func (p *tokenPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.tokens)
+}
+
+// Acquire 按策略选出一个token并计入并发，池为空时返回 false
+func (p *tokenPool) Acquire() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.tokens) == 0 {
+		return "", false
+	}
+
+	now := time.Now()
+	var healthy []*poolToken
+	for _, t := range p.tokens {
+		if t.healthy(now) {
+			healthy = append(healthy, t)
+		}
+	}
+
+	var chosen *poolToken
+	if len(healthy) == 0 {
+		// 全部在冷却中时选最早恢复的，总比直接失败好
+		for _, t := range p.tokens {
+			if chosen == nil || t.cooldownUntil.Before(chosen.cooldownUntil) {
+				chosen = t
+			}
+		}
+	} else {
+		switch p.strategy {
+		case strategyLeastInFlight:
+			for _, t := range healthy {
+				if chosen == nil || t.inFlight < chosen.inFlight {
+					chosen = t
+				}
+			}
+		case strategyWeighted:
+			// 平滑加权轮询
+			total := 0
+			for _, t := range healthy {
+				t.current += t.Weight
+				total += t.Weight
+				if chosen == nil || t.current > chosen.current {
+					chosen = t
+				}
+			}
+			chosen.current -= total
+		default:
+			chosen = healthy[p.next%len(healthy)]
+			p.next++
+		}
+	}
+
+	chosen.inFlight++
+	chosen.requests++
+	chosen.lastUsed = now
+	return chosen.Token, true
+}
+
+// Release 请求结束后释放并发计数，非池内token忽略
+func (p *tokenPool) Release(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t := p.byToken[token]; t != nil && t.inFlight > 0 {
+		t.inFlight--
+	}
+}
+
+// Report 记录上游响应状态，401/403/429 触发指数退避冷却
+func (p *tokenPool) Report(token string, status int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := p.byToken[token]
+	if t == nil {
+		return
+	}
+	t.lastStatus = status
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		t.failures++
+		cooldown := p.cooldownBase << (t.failures - 1)
+		if cooldown <= 0 || cooldown > p.cooldownMax {
+			cooldown = p.cooldownMax
+		}
+		t.cooldownUntil = time.Now().Add(cooldown)
+		debugLog("上游token %s 返回%d，冷却%v", maskToken(token), status, cooldown)
+	default:
+		if status < 400 {
+			t.failures = 0
+			t.cooldownUntil = time.Time{}
+		}
+	}
+}
+
+// tokenStatus 管理接口展示的token状态
+type tokenStatus struct {
+	Token         string     `json:"token"`
+	Weight        int        `json:"weight"`
+	Healthy       bool       `json:"healthy"`
+	InFlight      int        `json:"in_flight"`
+	Failures      int        `json:"failures"`
+	CooldownUntil *time.Time `json:"cooldown_until,omitempty"`
+	LastStatus    int        `json:"last_status,omitempty"`
+	Requests      int64      `json:"requests"`
+	LastUsed      *time.Time `json:"last_used,omitempty"`
+}
+
+// Snapshot 返回所有token的当前状态（token已脱敏）
+func (p *tokenPool) Snapshot() []tokenStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	out := make([]tokenStatus, 0, len(p.tokens))
+	for _, t := range p.tokens {
+		s := tokenStatus{
+			Token:      maskToken(t.Token),
+			Weight:     t.Weight,
+			Healthy:    t.healthy(now),
+			InFlight:   t.inFlight,
+			Failures:   t.failures,
+			LastStatus: t.lastStatus,
+			Requests:   t.requests,
+		}
+		if !s.Healthy {
+			until := t.cooldownUntil
+			s.CooldownUntil = &until
+		}
+		if !t.lastUsed.IsZero() {
+			last := t.lastUsed
+			s.LastUsed = &last
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// maskToken token脱敏，仅保留首尾少量字符
+func maskToken(token string) string {
+	if len(token) <= 12 {
+		return "***"
+	}
+	return token[:6] + "..." + token[len(token)-4:]
+}
+
+// checkAdminAuth 校验管理接口的Bearer key；未设置 ADMIN_KEY 时管理接口关闭
+func checkAdminAuth(w http.ResponseWriter, r *http.Request) bool {
+	adminKey := config().AdminKey
+	if adminKey == "" {
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "admin_disabled", "Admin endpoints are disabled; set ADMIN_KEY to enable them")
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+adminKey)) != 1 {
+		writeOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "Invalid admin key")
+		return false
+	}
+	return true
+}
+
+func handleAdminTokens(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !checkAdminAuth(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"strategy": upstreamPool.Strategy(),
+		"tokens":   upstreamPool.Snapshot(),
+	})
+}
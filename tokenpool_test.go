@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// acquireN 连续选取 n 次（不释放），返回选中的token序列
+func acquireN(p *tokenPool, n int) []string {
+	var got []string
+	for i := 0; i < n; i++ {
+		t, ok := p.Acquire()
+		if !ok {
+			return got
+		}
+		got = append(got, t)
+	}
+	return got
+}
+
+func TestTokenPoolCooldown(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		want     time.Duration // 最后一次上报后的冷却时间，0 表示健康
+	}{
+		{"first failure", []int{401}, time.Second},
+		{"second failure doubles", []int{401, 403}, 2 * time.Second},
+		{"rate limit counts as failure", []int{429, 429, 429}, 4 * time.Second},
+		{"capped at maximum", []int{401, 401, 401, 401, 401}, 5 * time.Second},
+		{"success recovers", []int{401, 401, 200}, 0},
+		{"failures counted again after recovery", []int{401, 401, 200, 401}, time.Second},
+		{"server errors do not cool down", []int{500, 502}, 0},
+		{"server error keeps existing cooldown", []int{401, 500}, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTokenPool([]string{"tok-a"}, strategyRoundRobin, time.Second, 5*time.Second)
+			var reported time.Time
+			for _, status := range tt.statuses {
+				reported = time.Now()
+				p.Report("tok-a", status)
+			}
+			tok := p.byToken["tok-a"]
+			if tt.want == 0 {
+				if !tok.healthy(time.Now()) || tok.failures != 0 {
+					t.Errorf("want healthy, got failures %d cooldown until %v", tok.failures, tok.cooldownUntil)
+				}
+				return
+			}
+			if got := tok.cooldownUntil.Sub(reported); got < tt.want-100*time.Millisecond || got > tt.want+100*time.Millisecond {
+				t.Errorf("cooldown %v, want %v", got, tt.want)
+			}
+			if tok.healthy(time.Now()) || !tok.healthy(reported.Add(tt.want+100*time.Millisecond)) {
+				t.Errorf("token should be unhealthy for %v only", tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenPoolSkipsUnhealthy(t *testing.T) {
+	for _, strategy := range []string{strategyRoundRobin, strategyLeastInFlight, strategyWeighted} {
+		t.Run(strategy, func(t *testing.T) {
+			p := newTokenPool([]string{"tok-a", "tok-b:3", "tok-c"}, strategy, time.Minute, time.Hour)
+			p.Report("tok-b", http.StatusUnauthorized)
+			seen := map[string]int{}
+			for _, tok := range acquireN(p, 12) {
+				seen[tok]++
+			}
+			if seen["tok-b"] > 0 {
+				t.Errorf("cooling token selected %d times", seen["tok-b"])
+			}
+			if seen["tok-a"] == 0 || seen["tok-c"] == 0 {
+				t.Errorf("healthy tokens not all used: %v", seen)
+			}
+
+			// 冷却结束后重新参与选择
+			p.byToken["tok-b"].cooldownUntil = time.Now().Add(-time.Millisecond)
+			seen = map[string]int{}
+			for _, tok := range acquireN(p, 12) {
+				seen[tok]++
+			}
+			if seen["tok-b"] == 0 {
+				t.Errorf("recovered token never selected: %v", seen)
+			}
+		})
+	}
+}
+
+func TestTokenPoolAllCoolingDown(t *testing.T) {
+	p := newTokenPool([]string{"tok-a", "tok-b", "tok-c"}, strategyRoundRobin, time.Minute, time.Hour)
+	p.Report("tok-a", http.StatusUnauthorized)
+	p.Report("tok-a", http.StatusUnauthorized)
+	p.Report("tok-b", http.StatusForbidden)
+	p.Report("tok-c", http.StatusTooManyRequests)
+	p.byToken["tok-c"].cooldownUntil = time.Now().Add(30 * time.Second)
+
+	// 全部在冷却中时选最早恢复的
+	for _, tok := range acquireN(p, 3) {
+		if tok != "tok-c" {
+			t.Errorf("got %s, want the token that recovers first", tok)
+		}
+	}
+}
+
+func TestTokenPoolLeastInFlight(t *testing.T) {
+	p := newTokenPool([]string{"tok-a", "tok-b"}, strategyLeastInFlight, time.Minute, time.Hour)
+	first, _ := p.Acquire()
+	second, _ := p.Acquire()
+	if first == second {
+		t.Fatalf("both requests on %s", first)
+	}
+	p.Release(first)
+	if third, _ := p.Acquire(); third != first {
+		t.Errorf("got %s, want the released token %s", third, first)
+	}
+}
+
+func TestTokenPoolUpdateKeepsState(t *testing.T) {
+	p := newTokenPool([]string{"tok-a", "tok-b"}, strategyRoundRobin, time.Minute, time.Hour)
+	p.Report("tok-a", http.StatusUnauthorized)
+	inFlight, _ := p.Acquire()
+
+	p.Update([]string{"tok-a:2", "tok-b", "tok-c"}, strategyWeighted, time.Minute, time.Hour)
+	if tok := p.byToken["tok-a"]; tok.failures != 1 || tok.healthy(time.Now()) || tok.Weight != 2 {
+		t.Errorf("tok-a state lost after update: %+v", tok)
+	}
+	if tok := p.byToken[inFlight]; tok.inFlight != 1 {
+		t.Errorf("%s in-flight count lost after update: %+v", inFlight, tok)
+	}
+
+	// 移除的token上的请求结束时忽略
+	p.Update([]string{"tok-c"}, strategyRoundRobin, time.Minute, time.Hour)
+	p.Release(inFlight)
+	if got := acquireN(p, 2); got[0] != "tok-c" || got[1] != "tok-c" {
+		t.Errorf("got %v, want only tok-c", got)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Tool OpenAI 工具定义
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+// ToolFunction 工具函数定义
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ToolCall 工具调用（流式增量中带 index）
+type ToolCall struct {
+	Index    *int             `json:"index,omitempty"`
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function ToolCallFunction `json:"function"`
+}
+
+// ToolCallFunction 工具调用的函数名与参数（参数为 JSON 字符串）
+type ToolCallFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+const (
+	toolCallOpen  = "<tool_call>"
+	toolCallClose = "</tool_call>"
+)
+
+// parseToolChoice 解析 tool_choice，返回模式（auto/none/required）与强制调用的函数名
+func parseToolChoice(raw json.RawMessage) (mode string, name string) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "auto", ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, ""
+	}
+	var obj struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(raw, &obj); err == nil && obj.Function.Name != "" {
+		return "required", obj.Function.Name
+	}
+	return "auto", ""
+}
+
+// buildToolPrompt 生成注入上游的工具说明
+func buildToolPrompt(tools []Tool, mode string, name string) string {
+	var defs []ToolFunction
+	for _, t := range tools {
+		if t.Type != "" && t.Type != "function" {
+			continue
+		}
+		if name != "" && t.Function.Name != name {
+			continue
+		}
+		defs = append(defs, t.Function)
+	}
+	defsJSON, _ := json.MarshalIndent(defs, "", "  ")
+
+	var b strings.Builder
+	b.WriteString("You have access to the following tools:\n")
+	b.Write(defsJSON)
+	b.WriteString("\n\nTo call a tool, reply with one block per call in exactly this format:\n")
+	b.WriteString(toolCallOpen + `{"name": "<tool name>", "arguments": {<arguments as a JSON object>}}` + toolCallClose + "\n")
+	b.WriteString("The arguments must be valid JSON matching the tool's parameters. ")
+	b.WriteString("After the tool call blocks, stop and wait: the results will be sent back to you in a later message.\n")
+	switch {
+	case name != "":
+		b.WriteString(fmt.Sprintf("You MUST call the tool %q now.", name))
+	case mode == "required":
+		b.WriteString("You MUST call at least one tool now.")
+	default:
+		b.WriteString("Only call a tool when it is needed; otherwise answer normally.")
+	}
+	return b.String()
+}
+
+// formatToolCall 将工具调用渲染为模型使用的文本格式
+func formatToolCall(call ToolCall) string {
+	args := json.RawMessage(call.Function.Arguments)
+	if !json.Valid(args) {
+		args, _ = json.Marshal(call.Function.Arguments)
+	}
+	payload, _ := json.Marshal(struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}{call.Function.Name, args})
+	return toolCallOpen + string(payload) + toolCallClose
+}
+
+// prepareToolMessages 将工具定义注入系统提示，并把 tool 结果与历史工具调用转换为上游可理解的纯文本消息
+func prepareToolMessages(messages []Message, tools []Tool, toolChoice json.RawMessage) []Message {
+	mode, name := parseToolChoice(toolChoice)
+
+	// 记录 tool_call_id -> 函数名，便于标注工具结果
+	callNames := map[string]string{}
+	var out []Message
+	for _, m := range messages {
+		switch {
+		case m.Role == "tool":
+			toolName := m.Name
+			if toolName == "" {
+				toolName = callNames[m.ToolCallID]
+			}
+			out = append(out, Message{
+				Role:    "user",
+				Content: fmt.Sprintf("<tool_result id=%q name=%q>\n%s\n</tool_result>", m.ToolCallID, toolName, m.Content),
+			})
+		case m.Role == "assistant" && len(m.ToolCalls) > 0:
+			var b strings.Builder
+			b.WriteString(m.Content)
+			for _, call := range m.ToolCalls {
+				callNames[call.ID] = call.Function.Name
+				if b.Len() > 0 {
+					b.WriteString("\n")
+				}
+				b.WriteString(formatToolCall(call))
+			}
+			out = append(out, Message{Role: "assistant", Content: b.String()})
+		default:
+			out = append(out, Message{Role: m.Role, Content: m.Content, Parts: m.Parts})
+		}
+	}
+
+	if len(tools) == 0 || mode == "none" {
+		return out
+	}
+
+	return appendSystemPrompt(out, buildToolPrompt(tools, mode, name))
+}
+
+// appendSystemPrompt 将提示追加到系统消息末尾，没有系统消息时新建一条
+func appendSystemPrompt(messages []Message, prompt string) []Message {
+	if len(messages) > 0 && messages[0].Role == "system" {
+		messages[0].Content = messages[0].Content + "\n\n" + prompt
+		return messages
+	}
+	return append([]Message{{Role: "system", Content: prompt}}, messages...)
+}
+
+// newToolCallID 生成工具调用ID
+func newToolCallID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "call_" + hex.EncodeToString(b)
+}
+
+// toolCallParser 从模型输出中增量提取 <tool_call> 块，其余内容原样透传
+type toolCallParser struct {
+	buf    strings.Builder // 尚未确定归属的内容
+	inCall bool
+	calls  int          // 已解析的调用数量，用作流式 index
+	log    *slog.Logger // 本次请求的日志
+}
+
+// newToolCallParser 创建工具调用解析器，log 为本次请求的日志
+func newToolCallParser(log *slog.Logger) *toolCallParser {
+	return &toolCallParser{log: log}
+}
+
+// Feed 输入一段增量文本，返回可以直接输出的文本与新解析出的工具调用
+func (p *toolCallParser) Feed(s string) (string, []ToolCall) {
+	p.buf.WriteString(s)
+	pending := p.buf.String()
+	p.buf.Reset()
+
+	var text strings.Builder
+	var calls []ToolCall
+	for {
+		if p.inCall {
+			end := strings.Index(pending, toolCallClose)
+			if end < 0 {
+				p.buf.WriteString(pending)
+				break
+			}
+			body := pending[:end]
+			pending = pending[end+len(toolCallClose):]
+			p.inCall = false
+			if call, ok := p.parseCall(body); ok {
+				calls = append(calls, call)
+			} else {
+				// 无法解析时按普通文本输出，避免吞掉内容
+				text.WriteString(toolCallOpen + body + toolCallClose)
+			}
+			continue
+		}
+
+		start := strings.Index(pending, toolCallOpen)
+		if start >= 0 {
+			text.WriteString(pending[:start])
+			pending = pending[start+len(toolCallOpen):]
+			p.inCall = true
+			continue
+		}
+		// 末尾可能是被拆开的起始标签，先保留
+		keep := partialSuffix(pending, toolCallOpen)
+		text.WriteString(pending[:len(pending)-keep])
+		p.buf.WriteString(pending[len(pending)-keep:])
+		break
+	}
+	return text.String(), calls
+}
+
+// Flush 在输出结束时返回所有剩余内容
+func (p *toolCallParser) Flush() string {
+	rest := p.buf.String()
+	p.buf.Reset()
+	if p.inCall {
+		p.inCall = false
+		return toolCallOpen + rest
+	}
+	return rest
+}
+
+func (p *toolCallParser) parseCall(body string) (ToolCall, bool) {
+	var raw struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(body)), &raw); err != nil {
+		p.log.Debug("工具调用解析失败，按文本输出", "error", err)
+		return ToolCall{}, false
+	}
+	if raw.Name == "" {
+		p.log.Debug("工具调用缺少函数名，按文本输出")
+		return ToolCall{}, false
+	}
+	args := string(raw.Arguments)
+	// 部分模型会把参数写成 JSON 字符串
+	var argStr string
+	if err := json.Unmarshal(raw.Arguments, &argStr); err == nil {
+		args = argStr
+	}
+	if args == "" || args == "null" {
+		args = "{}"
+	}
+	index := p.calls
+	p.calls++
+	return ToolCall{
+		Index: &index,
+		ID:    newToolCallID(),
+		Type:  "function",
+		Function: ToolCallFunction{
+			Name:      raw.Name,
+			Arguments: args,
+		},
+	}, true
+}
+
+// partialSuffix 返回 s 末尾与 tag 前缀重合的长度
+func partialSuffix(s string, tag string) int {
+	max := len(tag) - 1
+	if len(s) < max {
+		max = len(s)
+	}
+	for n := max; n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// feedTools 依次输入各段并在最后调用 Flush，返回全部文本与工具调用
+func feedTools(chunks []string) (string, []ToolCall) {
+	p := newToolCallParser(discardLogger)
+	var text strings.Builder
+	var calls []ToolCall
+	for _, c := range chunks {
+		t, cs := p.Feed(c)
+		text.WriteString(t)
+		calls = append(calls, cs...)
+	}
+	text.WriteString(p.Flush())
+	return text.String(), calls
+}
+
+func TestToolCallParserFeed(t *testing.T) {
+	type call struct{ name, args string }
+	tests := []struct {
+		name      string
+		chunks    []string
+		wantText  string
+		wantCalls []call
+	}{
+		{
+			name:     "plain text",
+			chunks:   []string{"hello ", "world"},
+			wantText: "hello world",
+		},
+		{
+			name:      "single call",
+			chunks:    []string{`<tool_call>{"name":"get_weather","arguments":{"city":"Paris"}}</tool_call>`},
+			wantCalls: []call{{"get_weather", `{"city":"Paris"}`}},
+		},
+		{
+			name:      "open tag split across chunks",
+			chunks:    []string{"Let me check.<tool", "_ca", `ll>{"name":"f","arguments":{}}</tool_call>`},
+			wantText:  "Let me check.",
+			wantCalls: []call{{"f", `{}`}},
+		},
+		{
+			name:      "close tag split across chunks",
+			chunks:    []string{`<tool_call>{"name":"f","arguments":{"a":1}}</tool`, "_call>done"},
+			wantText:  "done",
+			wantCalls: []call{{"f", `{"a":1}`}},
+		},
+		{
+			name:     "less-than that is not a tag",
+			chunks:   []string{"1 <", " 2 <to", "p"},
+			wantText: "1 < 2 <top",
+		},
+		{
+			name:     "invalid json falls back to text",
+			chunks:   []string{`<tool_call>{"name": "f", "arguments": </tool_call>`},
+			wantText: `<tool_call>{"name": "f", "arguments": </tool_call>`,
+		},
+		{
+			name:     "missing name falls back to text",
+			chunks:   []string{`<tool_call>{"arguments":{}}</tool_call>`},
+			wantText: `<tool_call>{"arguments":{}}</tool_call>`,
+		},
+		{
+			name:      "string-encoded arguments",
+			chunks:    []string{`<tool_call>{"name":"f","arguments":"{\"q\":\"x\"}"}</tool_call>`},
+			wantCalls: []call{{"f", `{"q":"x"}`}},
+		},
+		{
+			name:      "missing arguments",
+			chunks:    []string{`<tool_call>{"name":"f"}</tool_call>`},
+			wantCalls: []call{{"f", `{}`}},
+		},
+		{
+			name: "multiple calls",
+			chunks: []string{
+				"<tool_call>\n{\"name\":\"a\",\"arguments\":{\"x\":1}}\n</tool_call>\n",
+				`<tool_call>{"name":"b","arguments":{"y":2}}</tool_call>`,
+			},
+			wantText:  "\n",
+			wantCalls: []call{{"a", `{"x":1}`}, {"b", `{"y":2}`}},
+		},
+		{
+			name:     "unclosed call flushed as text",
+			chunks:   []string{`<tool_call>{"name":"f"`},
+			wantText: `<tool_call>{"name":"f"`,
+		},
+		{
+			name:     "partial open tag flushed as text",
+			chunks:   []string{"bye <tool_"},
+			wantText: "bye <tool_",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, calls := feedTools(tt.chunks)
+			if text != tt.wantText {
+				t.Errorf("text %q, want %q", text, tt.wantText)
+			}
+			if len(calls) != len(tt.wantCalls) {
+				t.Fatalf("got %d calls, want %d: %+v", len(calls), len(tt.wantCalls), calls)
+			}
+			for i, c := range calls {
+				if c.Function.Name != tt.wantCalls[i].name || c.Function.Arguments != tt.wantCalls[i].args {
+					t.Errorf("call %d: got %s(%s), want %s(%s)", i, c.Function.Name, c.Function.Arguments, tt.wantCalls[i].name, tt.wantCalls[i].args)
+				}
+				if c.Index == nil || *c.Index != i {
+					t.Errorf("call %d: index %v", i, c.Index)
+				}
+				if c.Type != "function" || !strings.HasPrefix(c.ID, "call_") {
+					t.Errorf("call %d: type %q id %q", i, c.Type, c.ID)
+				}
+			}
+		})
+	}
+}
+
+// 整段输出在任意位置拆成两段，结果都应与不拆分时相同
+func TestToolCallParserEverySplitPoint(t *testing.T) {
+	whole := `text <tool_call>{"name":"f","arguments":{"a":"<b>"}}</tool_call> tail`
+	for i := 1; i < len(whole); i++ {
+		text, calls := feedTools([]string{whole[:i], whole[i:]})
+		if text != "text  tail" || len(calls) != 1 || calls[0].Function.Arguments != `{"a":"<b>"}` {
+			t.Fatalf("split at %d (%q | %q): text %q, calls %+v", i, whole[:i], whole[i:], text, calls)
+		}
+	}
+}
+
+func TestPrepareToolMessages(t *testing.T) {
+	tools := []Tool{{Type: "function", Function: ToolFunction{Name: "get_weather"}}}
+	messages := []Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "Weather in Paris?"},
+		{Role: "assistant", Content: "Checking.", ToolCalls: []ToolCall{
+			{ID: "call_1", Type: "function", Function: ToolCallFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+			{ID: "call_2", Type: "function", Function: ToolCallFunction{Name: "get_time", Arguments: "not json"}},
+		}},
+		{Role: "tool", ToolCallID: "call_1", Content: "sunny"},
+		{Role: "tool", ToolCallID: "call_2", Name: "clock", Content: "noon"},
+	}
+
+	out := prepareToolMessages(messages, tools, nil)
+	want := []struct{ role, content string }{
+		{"system", "Be brief.\n\nYou have access to the following tools:"},
+		{"user", "Weather in Paris?"},
+		{"assistant", "Checking.\n" +
+			`<tool_call>{"name":"get_weather","arguments":{"city":"Paris"}}</tool_call>` + "\n" +
+			`<tool_call>{"name":"get_time","arguments":"not json"}</tool_call>`},
+		{"user", "<tool_result id=\"call_1\" name=\"get_weather\">\nsunny\n</tool_result>"},
+		{"user", "<tool_result id=\"call_2\" name=\"clock\">\nnoon\n</tool_result>"},
+	}
+	if len(out) != len(want) {
+		t.Fatalf("got %d messages, want %d: %+v", len(out), len(want), out)
+	}
+	for i, w := range want {
+		if out[i].Role != w.role {
+			t.Errorf("message %d: role %q, want %q", i, out[i].Role, w.role)
+		}
+		if i == 0 {
+			if !strings.HasPrefix(out[i].Content, w.content) {
+				t.Errorf("message %d: content %q, want prefix %q", i, out[i].Content, w.content)
+			}
+			continue
+		}
+		if out[i].Content != w.content {
+			t.Errorf("message %d: content %q, want %q", i, out[i].Content, w.content)
+		}
+		if len(out[i].ToolCalls) > 0 || out[i].ToolCallID != "" {
+			t.Errorf("message %d still carries tool fields: %+v", i, out[i])
+		}
+	}
+}
+
+func TestPrepareToolMessagesToolChoice(t *testing.T) {
+	tools := []Tool{
+		{Type: "function", Function: ToolFunction{Name: "a"}},
+		{Type: "function", Function: ToolFunction{Name: "b"}},
+	}
+	tests := []struct {
+		name       string
+		toolChoice string
+		wantPrompt bool
+		contains   string
+		excludes   string
+	}{
+		{"auto", ``, true, "Only call a tool when it is needed", ""},
+		{"none", `"none"`, false, "", ""},
+		{"required", `"required"`, true, "You MUST call at least one tool", ""},
+		{"named function", `{"type":"function","function":{"name":"b"}}`, true, `You MUST call the tool "b"`, `"name": "a"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := prepareToolMessages([]Message{{Role: "user", Content: "hi"}}, tools, []byte(tt.toolChoice))
+			if !tt.wantPrompt {
+				if len(out) != 1 || out[0].Role != "user" {
+					t.Fatalf("unexpected system prompt: %+v", out)
+				}
+				return
+			}
+			if len(out) != 2 || out[0].Role != "system" {
+				t.Fatalf("want a new system message, got %+v", out)
+			}
+			if !strings.Contains(out[0].Content, tt.contains) {
+				t.Errorf("prompt %q does not contain %q", out[0].Content, tt.contains)
+			}
+			if tt.excludes != "" && strings.Contains(out[0].Content, tt.excludes) {
+				t.Errorf("prompt %q should not contain %q", out[0].Content, tt.excludes)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer 在 initTracing 设置全局 TracerProvider 之前为 no-op
+var tracer = otel.Tracer("z2api")
+
+// initTracing 配置了 OTEL_EXPORTER_OTLP_ENDPOINT（或 OTEL_EXPORTER_OTLP_TRACES_ENDPOINT、配置文件中的 otlp_endpoint）时
+// 通过 OTLP/HTTP 导出span，返回进程退出前需调用的关闭函数。
+// 导出地址、请求头、采样率等使用 OpenTelemetry 标准环境变量。
+func initTracing() func(context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if config().OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }
+	}
+
+	ctx := context.Background()
+	var opts []otlptracehttp.Option
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		// 只在配置文件中设置时，与 OTEL_EXPORTER_OTLP_ENDPOINT 一样视为基础地址
+		opts = append(opts, otlptracehttp.WithEndpointURL(strings.TrimSuffix(config().OTLPEndpoint, "/")+"/v1/traces"))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		logger(ctx).Error("创建OTLP导出器失败，tracing未启用", "error", err)
+		return func(context.Context) error { return nil }
+	}
+	// OTEL_SERVICE_NAME、OTEL_RESOURCE_ATTRIBUTES 覆盖默认服务名
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "z2api")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		logger(ctx).Warn("读取tracing资源属性失败", "error", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	logger(ctx).Info("tracing已启用", "endpoint", config().OTLPEndpoint)
+	return provider.Shutdown
+}
+
+// withTracing 读取请求中的 W3C traceparent，并为整个请求创建服务端span
+func withTracing(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("request.id", requestID(r.Context())),
+			))
+		defer span.End()
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// endSpan 结束span，err 非空时标记为错误
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// streamTrace 记录上游SSE流：等待首帧的span，以及每个阶段（thinking/answer等）一个span
+type streamTrace struct {
+	ctx    context.Context
+	wait   trace.Span // 等待首帧，收到首帧后结束
+	phase  string
+	span   trace.Span // 当前阶段
+	frames int        // 当前阶段的帧数
+}
+
+// startStreamTrace 在拿到上游响应后调用，开始等待首帧
+func startStreamTrace(ctx context.Context) *streamTrace {
+	_, wait := tracer.Start(ctx, "upstream.first_frame")
+	return &streamTrace{ctx: ctx, wait: wait}
+}
+
+// Frame 收到一个上游事件；阶段变化时结束上一阶段的span并开始新的
+func (t *streamTrace) Frame(phase string) {
+	if t.wait != nil {
+		t.wait.End()
+		t.wait = nil
+	}
+	if phase != "" && phase != t.phase {
+		t.endPhase()
+		t.phase = phase
+		_, t.span = tracer.Start(t.ctx, "upstream.phase."+phase, trace.WithAttributes(attribute.String("phase", phase)))
+	}
+	t.frames++
+}
+
+func (t *streamTrace) endPhase() {
+	if t.span != nil {
+		t.span.SetAttributes(attribute.Int("frames", t.frames))
+		t.span.End()
+		t.span = nil
+		t.frames = 0
+	}
+}
+
+// End 上游流结束，可重复调用；fail 非空表示流异常中断
+func (t *streamTrace) End(fail *upstreamFailure) {
+	var err error
+	if fail != nil && fail.Status != 0 {
+		err = fail
+	}
+	if t.wait != nil {
+		endSpan(t.wait, err)
+		t.wait = nil
+	}
+	if t.span != nil {
+		t.span.SetAttributes(attribute.Int("frames", t.frames))
+		endSpan(t.span, err)
+		t.span = nil
+	}
+}